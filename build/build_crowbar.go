@@ -3,9 +3,7 @@ package build
 
 import (
 	"fmt"
-	"io/ioutil"
 	"launchpad.net/goyaml"
-	"log"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -33,186 +31,253 @@ type PackagesSection struct {
 	BuildPackages []string `yaml:"build_pkgs"`
 }
 
-// Debs tracks Debian package requirements.
-type DebsSection struct {
-	PackagesSection
-	Ubuntu1204 *PackagesSection `yaml:"ubuntu-12.04"`
-}
-
-// Rpms tracks RPM specific package requirements.
-type RpmsSection struct {
-	PackagesSection
-	Redhat64 *PackagesSection `yaml:"redhat-6.4"`
-	Centos64 *PackagesSection `yaml:"centos-6.4"`
+// OSPackagesSection tracks the package requirements for a packaging
+// system, such as debs or rpms.  The requirements common to every OS are
+// in the embedded PackagesSection, and OS holds the extra requirements
+// for each OS, keyed by OS name (such as ubuntu-12.04).
+type OSPackagesSection struct {
+	PackagesSection `yaml:",inline"`
+	OS              map[string]*PackagesSection `yaml:"-"`
 }
 
 // BarclampMeta holds all of the metadata from crowbar.yml we care about.
 type CrowbarYML struct {
 	Barclamp   *BarclampSection
-	Debs       *DebsSection
-	Rpms       *RpmsSection
+	Debs       *OSPackagesSection
+	Rpms       *OSPackagesSection
 	Gems       *PackagesSection
-	sortedDeps []string
 	ExtraFiles []string `yaml:"extra_files"`
 	GitRepos   []string `yaml:"git_repo"`
 }
 
-// For dependency sorting barclamps.
+// CrowbarYMLs is a list of barclamp metadata, in the order
+// the barclamps should be installed in.
 type CrowbarYMLs []*CrowbarYML
 
-func (s CrowbarYMLs) Len() int {
-	return len(s)
+func (c *CrowbarYML) String() string {
+	return fmt.Sprintf("%s: %v", c.Barclamp.Name, c.Barclamp.Requires)
 }
 
-func (s CrowbarYMLs) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+// Substitution records what happened when one barclamp superceded another.
+type Substitution struct {
+	// The barclamp that declared the supercedes, and the one it replaced.
+	Replacement string `json:"replacement"`
+	Victim      string `json:"victim"`
+	// Whether the victim was actually present and got removed.
+	Removed bool `json:"removed"`
+	// The barclamps whose Requires were redirected from Victim to Replacement.
+	Requires []string `json:"requires,omitempty"`
+	// The groups that Replacement was added to in place of Victim.
+	Groups []string `json:"groups,omitempty"`
 }
 
-// s[i] is less than s[j] iff s[j] depends on s[i]
-func (s CrowbarYMLs) Less(i, j int) bool {
-	return len(s[i].deps()) < len(s[j].deps())
+func (s *Substitution) String() string {
+	res := fmt.Sprintf("%s supercedes %s", s.Replacement, s.Victim)
+	if !s.Removed {
+		res += " (not present)"
+	}
+	if len(s.Requires) > 0 {
+		res += fmt.Sprintf(", redirected requires in %s", strings.Join(s.Requires, ", "))
+	}
+	if len(s.Groups) > 0 {
+		res += fmt.Sprintf(", took over membership in %s", strings.Join(s.Groups, ", "))
+	}
+	return res
 }
 
-func (c *CrowbarYML) String() string {
-	return fmt.Sprintf("%s: %v",c.Barclamp.Name,c.deps())
-}
-
-// Get the ordered list of dependencies for this barclamp metadata.
-// All barclamps except for the crowbar barclamp get a free dependency on the
-// crowbar barclamp.
-// This should not be called until after we have established the overall global
-// barclamp order, which will catch missing barclamps and circular dependencies.
-func (b *CrowbarYML) deps() []string {
-	if b.Barclamp.Name == "crowbar" {
-		// special case: crowbar barclamp has no dependencies.
-		return make([]string,0,0)
-	}
-	if len(b.sortedDeps) > 0 {
-		return b.sortedDeps
-	}
-	// Everyone who is not Crowbar depends on Crowbar
-	found_deps := make(map[int][]string)
-	found_deps[1]=[]string{"crowbar"}
-	// Find all our dependencies, sorted by how many dependencies they have.
-	for _, n := range b.Barclamp.Requires {
-		bc,ok := allMetadata[n]
-		// If we cannot find metadata for n, we are doomed.
-		// Doomed.
-		if !ok {
-			log.Fatalf("%s has %s in its dependency chain, but %s does not exist!", b.Barclamp.Name, n, n)
-		}
-		t := append(bc.deps(),n)
-		rank := len(t)
-		_, ok = found_deps[rank]
-		if !ok {
-			found_deps[rank] = t
-		} else {
-			found_deps[rank] = append(found_deps[rank], t...)
-		}
-		// If our name is in our list of dependencies, then there is a
-		// curcular dependency.  Handle it by dying horribly.
-		for _,k := range t {
-			if k == b.Barclamp.Name {
-				log.Fatalf("%s cannot depend on itself!",k)
+// Find what a barclamp has ultimately been replaced with,
+// following chains of supercedes directives.
+func resolveReplacement(name string, replacements map[string]string) (string, error) {
+	seen := map[string]bool{name: true}
+	for {
+		next, found := replacements[name]
+		if !found {
+			return name, nil
+		}
+		if seen[next] {
+			return "", fmt.Errorf("Barclamps supercede each other in a loop starting at %s", next)
+		}
+		seen[next] = true
+		name = next
+	}
+}
+
+// Process all the supercedes directives in metadata.  Superceded barclamps
+// are removed, their replacements take over their group memberships, and
+// anything that required a superceded barclamp requires its replacement instead.
+// This must be called before groups are assembled and expanded.
+func processSupercedes(metadata map[string]*CrowbarYML) ([]*Substitution, error) {
+	replacements := make(map[string]string)
+	res := make([]*Substitution, 0)
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, victim := range metadata[name].Barclamp.Supercedes {
+			if other, found := replacements[victim]; found && other != name {
+				return nil, fmt.Errorf("%s is superceded by both %s and %s", victim, other, name)
 			}
+			replacements[victim] = name
+			res = append(res, &Substitution{Replacement: name, Victim: victim})
 		}
 	}
-	// Figure out what ranks we have, then sort them.
-	ranks := make([]int, 0, len(found_deps))
-	for i := range found_deps {
-		ranks = append(ranks, i)
-		// Sorting here ensures that our overall global order will
-		// remain consistent.
-		sort.Strings(found_deps[i])
-	}
-	sort.Ints(ranks)
-	// Figure out the overall global ordering and remember it.
-	final_deps := make(map[string]int)
-	final_rank := int(0)
-	for _, rank := range ranks {
-		for _, dep := range found_deps[rank] {
-			if _, ok := final_deps[dep]; !ok {
-				final_deps[dep] = final_rank
-				final_rank += 1
+	bySub := make(map[string]*Substitution)
+	for _, sub := range res {
+		replacement, err := resolveReplacement(sub.Victim, replacements)
+		if err != nil {
+			return nil, err
+		}
+		sub.Replacement = replacement
+		bySub[sub.Victim] = sub
+		victim, found := metadata[sub.Victim]
+		if !found {
+			continue
+		}
+		sub.Removed = true
+		delete(metadata, sub.Victim)
+		// The replacement takes over group memberships from the victim.
+		replBC := metadata[replacement].Barclamp
+		for _, member := range victim.Barclamp.Member {
+			already := false
+			for _, m := range replBC.Member {
+				if m == member {
+					already = true
+					break
+				}
+			}
+			if !already {
+				replBC.Member = append(replBC.Member, member)
+				sub.Groups = append(sub.Groups, member)
 			}
 		}
 	}
-	// Invert final rank directly into res
-	res := make([]string, final_rank, final_rank)
-	for dep,i := range final_deps {
-		res[i] = dep
+	// Redirect requirements on victims to their replacements.
+	for _, name := range names {
+		bc, found := metadata[name]
+		if !found {
+			continue
+		}
+		newRequires := make([]string, 0, len(bc.Barclamp.Requires))
+		seen := make(map[string]bool)
+		for _, req := range bc.Barclamp.Requires {
+			if sub, found := bySub[req]; found {
+				// A replacement that requires its victim just
+				// loses the requirement.
+				if name != sub.Replacement {
+					sub.Requires = append(sub.Requires, name)
+				}
+				req = sub.Replacement
+			}
+			if req == name || seen[req] {
+				continue
+			}
+			seen[req] = true
+			newRequires = append(newRequires, req)
+		}
+		bc.Barclamp.Requires = newRequires
 	}
-	b.sortedDeps = res
-	return res
+	return res, nil
 }
 
-type group struct {
-	name    string
-	members []string
+// MetadataSet is a set of crowbar.yml files that have been loaded and
+// processed together, such as all the barclamps in a build.
+// Use LoadMetadata or LoadSources to get one.
+type MetadataSet struct {
+	// The barclamps that are left after supercedes directives have been
+	// processed, keyed by name.  Their Requires have had groups expanded
+	// and superceded barclamps replaced.
+	Barclamps map[string]*CrowbarYML
+	// The members of each group, keyed by group name without the @.
+	Groups map[string][]string
+	// The order the barclamps should be installed in.
+	Order []string
+	// What happened because of supercedes directives.
+	Substitutions []*Substitution
 }
 
-var allMetadata map[string]*CrowbarYML = make(map[string]*CrowbarYML)
-var sortedMetadata CrowbarYMLs = make(CrowbarYMLs, 0, 0)
-var groups map[string]*group = make(map[string]*group)
-
-// Loads (but does not process) metadata for a single barclamp.
-func loadOneMeta(path string) (res *CrowbarYML, err error) {
-	if filepath.Base(path) != "crowbar.yml" {
+// Parses (but does not process) the contents of a crowbar.yml file.
+func parseMeta(data []byte) (res *CrowbarYML, err error) {
+	if err = goyaml.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	if res == nil || res.Barclamp == nil {
 		return nil, NotABarclamp
 	}
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
+	if err = res.loadOSSections(data); err != nil {
 		return nil, err
 	}
-	err = goyaml.Unmarshal(data, &res)
-	return res, err
+	return res, nil
 }
 
-func SanityCheckMetadata(paths []string) {
+// LoadMetadata loads the crowbar.yml files at paths, processes their
+// supercedes, member, and requires directives, and works out the order
+// the barclamps should be installed in.
+func LoadMetadata(paths []string) (*MetadataSet, error) {
+	srcs := make([]*Source, 0, len(paths))
 	for _, path := range paths {
-		bc, err := loadOneMeta(path)
+		if filepath.Base(path) != "crowbar.yml" {
+			return nil, fmt.Errorf("%s: %v", path, NotABarclamp)
+		}
+		src, err := ReadSource(path)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, fmt.Errorf("%s: %v", path, err)
 		}
-		allMetadata[bc.Barclamp.Name] = bc
+		srcs = append(srcs, src)
 	}
-	// Process supercedes directives first.
-	toRemove := make(map[string]bool)
-	for name, bc := range allMetadata {
-		for _, victim := range bc.Barclamp.Supercedes {
-			log.Printf("%s supercedes %s\n", name, victim)
-			toRemove[name] = true
+	return LoadSources(srcs)
+}
+
+// LoadSources is LoadMetadata for crowbar.yml files that have
+// already been read.
+func LoadSources(srcs []*Source) (*MetadataSet, error) {
+	res := &MetadataSet{
+		Barclamps: make(map[string]*CrowbarYML),
+		Groups:    make(map[string][]string),
+	}
+	for _, src := range srcs {
+		bc, err := parseMeta(src.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.Path, err)
 		}
+		if _, found := res.Barclamps[bc.Barclamp.Name]; found {
+			return nil, fmt.Errorf("%s: barclamp %s is defined more than once", src.Path, bc.Barclamp.Name)
+		}
+		res.Barclamps[bc.Barclamp.Name] = bc
 	}
-	for name := range toRemove {
-		delete(allMetadata, name)
+	if err := res.process(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Process the supercedes, member, and requires directives, and
+// figure out the install order.
+func (m *MetadataSet) process() (err error) {
+	// Process supercedes directives first.
+	if m.Substitutions, err = processSupercedes(m.Barclamps); err != nil {
+		return err
 	}
 	// Once supercedes directives are processed, we can assemble groups
 	// from the members sections of the metadata.
-	for name, bc := range allMetadata {
-		for _, member := range bc.Barclamp.Member {
-			grp, ok := groups[member]
-			if !ok {
-				groups[member] = &group{name: member, members: []string{name}}
-			} else {
-				grp.members = append(grp.members, name)
-			}
+	for _, name := range m.names() {
+		for _, member := range m.Barclamps[name].Barclamp.Member {
+			member = strings.TrimPrefix(member, "@")
+			m.Groups[member] = append(m.Groups[member], name)
 		}
 	}
-
 	// Once groups are processed, we can expand dependencies.
-	for name, bc := range allMetadata {
+	for name, bc := range m.Barclamps {
 		newRequires := make([]string, 0, len(bc.Barclamp.Requires))
 		for _, requirement := range bc.Barclamp.Requires {
 			if strings.HasPrefix(requirement, "@") {
 				//This is a group requirement.  Expand it.
-				g, ok := groups[strings.TrimPrefix(requirement, "@")]
+				members, ok := m.Groups[strings.TrimPrefix(requirement, "@")]
 				if !ok {
-					log.Fatalf("%s requires group %s, which does not exist!", name, requirement)
-				}
-				for _, n := range g.members {
-					newRequires = append(newRequires, n)
+					return fmt.Errorf("%s requires group %s, which does not exist!", name, requirement)
 				}
+				newRequires = append(newRequires, members...)
 			} else {
 				newRequires = append(newRequires, requirement)
 			}
@@ -222,8 +287,68 @@ func SanityCheckMetadata(paths []string) {
 	}
 	// Once all dependencies are expanded, we can figure out the global
 	// order we will walk over barclamps in.
-	for _, bc := range allMetadata {
-		sortedMetadata = append(sortedMetadata, bc)
+	m.Order, err = Toposort(m.Barclamps)
+	return err
+}
+
+// The names of all the barclamps in the set, sorted.
+func (m *MetadataSet) names() []string {
+	res := make([]string, 0, len(m.Barclamps))
+	for name := range m.Barclamps {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Sorted returns the metadata for all the barclamps in install order.
+func (m *MetadataSet) Sorted() CrowbarYMLs {
+	res := make(CrowbarYMLs, 0, len(m.Order))
+	for _, name := range m.Order {
+		res = append(res, m.Barclamps[name])
+	}
+	return res
+}
+
+// Deps returns everything a barclamp depends on, directly or indirectly,
+// in install order.
+func (m *MetadataSet) Deps(name string) ([]string, error) {
+	if _, found := m.Barclamps[name]; !found {
+		return nil, fmt.Errorf("%s is not in the metadata set", name)
+	}
+	needed := make(map[string]bool)
+	todo := requirements(name, m.Barclamps)
+	for len(todo) > 0 {
+		dep := todo[0]
+		todo = todo[1:]
+		if needed[dep] {
+			continue
+		}
+		needed[dep] = true
+		todo = append(todo, requirements(dep, m.Barclamps)...)
+	}
+	res := make([]string, 0, len(needed))
+	for _, dep := range m.Order {
+		if needed[dep] {
+			res = append(res, dep)
+		}
+	}
+	return res, nil
+}
+
+// Validate rechecks the set after it has been changed: every barclamp
+// must have OS sections that match its os_support, and the dependencies
+// must still be orderable.  The install order is updated to match.
+func (m *MetadataSet) Validate() error {
+	for _, name := range m.names() {
+		if err := m.Barclamps[name].CheckOSSupport(); err != nil {
+			return err
+		}
+	}
+	order, err := Toposort(m.Barclamps)
+	if err != nil {
+		return err
 	}
-	sort.Sort(sortedMetadata)
+	m.Order = order
+	return nil
 }
@@ -0,0 +1,153 @@
+package build
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestProcessSupercedes(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]*CrowbarYML
+		// The barclamps left afterwards, and what they require and are members of.
+		requires map[string][]string
+		members  map[string][]string
+		subs     []*Substitution
+		fails    bool
+	}{
+		{
+			name: "victim is removed",
+			metadata: map[string]*CrowbarYML{
+				"new": {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}}},
+				"old": {Barclamp: &BarclampSection{Name: "old"}},
+			},
+			requires: map[string][]string{"new": {}},
+			subs:     []*Substitution{{Replacement: "new", Victim: "old", Removed: true}},
+		},
+		{
+			name: "missing victim",
+			metadata: map[string]*CrowbarYML{
+				"new": {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}}},
+			},
+			requires: map[string][]string{"new": {}},
+			subs:     []*Substitution{{Replacement: "new", Victim: "old"}},
+		},
+		{
+			name: "chained supercedes",
+			metadata: map[string]*CrowbarYML{
+				"a": {Barclamp: &BarclampSection{Name: "a", Supercedes: []string{"b"}}},
+				"b": {Barclamp: &BarclampSection{Name: "b", Supercedes: []string{"c"}}},
+				"c": {Barclamp: &BarclampSection{Name: "c"}},
+				"d": {Barclamp: &BarclampSection{Name: "d", Requires: []string{"c"}}},
+			},
+			requires: map[string][]string{"a": {}, "d": {"a"}},
+			subs: []*Substitution{
+				{Replacement: "a", Victim: "b", Removed: true},
+				{Replacement: "a", Victim: "c", Removed: true, Requires: []string{"d"}},
+			},
+		},
+		{
+			name: "requires are redirected",
+			metadata: map[string]*CrowbarYML{
+				"new":  {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}, Requires: []string{"old", "base"}}},
+				"old":  {Barclamp: &BarclampSection{Name: "old", Requires: []string{"base"}}},
+				"base": {Barclamp: &BarclampSection{Name: "base"}},
+				"x":    {Barclamp: &BarclampSection{Name: "x", Requires: []string{"old", "new"}}},
+			},
+			requires: map[string][]string{"new": {"base"}, "base": {}, "x": {"new"}},
+			subs: []*Substitution{
+				{Replacement: "new", Victim: "old", Removed: true, Requires: []string{"x"}},
+			},
+		},
+		{
+			name: "replacement requires its victim",
+			metadata: map[string]*CrowbarYML{
+				"new": {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}, Requires: []string{"old"}}},
+				"old": {Barclamp: &BarclampSection{Name: "old"}},
+			},
+			requires: map[string][]string{"new": {}},
+			subs:     []*Substitution{{Replacement: "new", Victim: "old", Removed: true}},
+		},
+		{
+			name: "replacement takes over groups",
+			metadata: map[string]*CrowbarYML{
+				"new": {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}, Member: []string{"@core"}}},
+				"old": {Barclamp: &BarclampSection{Name: "old", Member: []string{"@core", "@network"}}},
+			},
+			requires: map[string][]string{"new": {}},
+			members:  map[string][]string{"new": {"@core", "@network"}},
+			subs: []*Substitution{
+				{Replacement: "new", Victim: "old", Removed: true, Groups: []string{"@network"}},
+			},
+		},
+		{
+			name: "victim superceded twice",
+			metadata: map[string]*CrowbarYML{
+				"a":   {Barclamp: &BarclampSection{Name: "a", Supercedes: []string{"old"}}},
+				"b":   {Barclamp: &BarclampSection{Name: "b", Supercedes: []string{"old"}}},
+				"old": {Barclamp: &BarclampSection{Name: "old"}},
+			},
+			fails: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subs, err := processSupercedes(test.metadata)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", subs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			requires := make(map[string][]string)
+			for name, bc := range test.metadata {
+				requires[name] = bc.Barclamp.Requires
+			}
+			if !reflect.DeepEqual(requires, test.requires) {
+				t.Errorf("Expected requires %v, got %v", test.requires, requires)
+			}
+			for name, members := range test.members {
+				if !reflect.DeepEqual(test.metadata[name].Barclamp.Member, members) {
+					t.Errorf("Expected %s to be a member of %v, got %v", name, members, test.metadata[name].Barclamp.Member)
+				}
+			}
+			sort.Slice(subs, func(i, j int) bool { return subs[i].Victim < subs[j].Victim })
+			if !reflect.DeepEqual(subs, test.subs) {
+				t.Errorf("Expected substitutions %v, got %v", test.subs, subs)
+			}
+		})
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	m := &MetadataSet{
+		Barclamps: map[string]*CrowbarYML{
+			"crowbar": {Barclamp: &BarclampSection{Name: "crowbar"}},
+			"new":     {Barclamp: &BarclampSection{Name: "new", Supercedes: []string{"old"}}},
+			"old":     {Barclamp: &BarclampSection{Name: "old", Member: []string{"@core"}}},
+			"dns":     {Barclamp: &BarclampSection{Name: "dns", Member: []string{"@core"}}},
+			"app":     {Barclamp: &BarclampSection{Name: "app", Requires: []string{"@core"}}},
+		},
+		Groups: make(map[string][]string),
+	}
+	if err := m.process(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"dns", "new"}; !reflect.DeepEqual(m.Groups["core"], expected) {
+		t.Errorf("Expected core to be %v, got %v", expected, m.Groups["core"])
+	}
+	if expected := []string{"dns", "new"}; !reflect.DeepEqual(m.Barclamps["app"].Barclamp.Requires, expected) {
+		t.Errorf("Expected app to require %v, got %v", expected, m.Barclamps["app"].Barclamp.Requires)
+	}
+	if expected := []string{"crowbar", "dns", "new", "app"}; !reflect.DeepEqual(m.Order, expected) {
+		t.Errorf("Expected order %v, got %v", expected, m.Order)
+	}
+	m.Barclamps["app"].Barclamp.Requires = []string{"@missing"}
+	if err := m.process(); err == nil {
+		t.Errorf("Expected requiring a missing group to fail")
+	}
+}
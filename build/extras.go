@@ -0,0 +1,292 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extra is something a barclamp needs at build time that is not part of
+// the barclamp itself: either a file from extra_files that has to be
+// downloaded, or a git repository from git_repo.  Extras are kept in a
+// local cache so that builds do not need the network.
+type Extra struct {
+	Barclamp string `json:"barclamp"`
+	// Either "file" or "git_repo".
+	Kind string `json:"kind"`
+	// The URL to fetch the extra from.
+	Source string `json:"source"`
+	// The branches of a git repo that the barclamp wants.
+	Branches []string `json:"branches,omitempty"`
+	// Where the extra lives in the cache.
+	Path string `json:"path"`
+	// Whether the extra is in the cache.  Set by Check.
+	Cached bool `json:"cached"`
+	// The branches of a git repo that are not in the cache.  Set by Check.
+	MissingBranches []string `json:"missing_branches,omitempty"`
+}
+
+func (e *Extra) String() string {
+	if e.Kind == "git_repo" {
+		return fmt.Sprintf("git repo %s (%s)", e.Source, strings.Join(e.Branches, ", "))
+	}
+	return fmt.Sprintf("file %s", e.Source)
+}
+
+// Make sure that a relative path from crowbar.yml that becomes part of a
+// path in the cache cannot point outside of it.
+func checkCachePath(what, p string) error {
+	if filepath.IsAbs(p) {
+		return fmt.Errorf("%s %s must be a relative path", what, p)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(p), "/") {
+		if part == ".." {
+			return fmt.Errorf("%s %s must not contain ..", what, p)
+		}
+	}
+	return nil
+}
+
+// Make sure that a barclamp name can be used as a directory in the cache.
+func checkCacheName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("barclamp name %q cannot be used as a directory name", name)
+	}
+	return nil
+}
+
+// Parse an extra_files entry, which is the file (or the URL to fetch it
+// from) and optionally the directory it should be put in.
+func parseExtraFile(entry string) (file, dest string, err error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("Empty extra_files entry")
+	}
+	if len(fields) > 1 {
+		dest = fields[1]
+		if err = checkCachePath("extra_files destination", dest); err != nil {
+			return "", "", err
+		}
+	}
+	if strings.Contains(fields[0], "://") {
+		switch path.Base(fields[0]) {
+		case ".", "..", "/":
+			return "", "", fmt.Errorf("extra_files URL %s does not name a file", fields[0])
+		}
+	}
+	return fields[0], dest, nil
+}
+
+// Where a downloaded extra file is cached, relative to the barclamp's
+// directory in the cache.
+func extraFileCachePath(url, dest string) string {
+	return filepath.Join("files", dest, path.Base(url))
+}
+
+// Parse a git_repo entry, which is the name of the repo, the URL to
+// clone it from, and optionally the branches we need.  If no branches
+// are given, we need master.
+func parseGitRepo(entry string) (name, url string, branches []string, err error) {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return "", "", nil, fmt.Errorf("git_repo entry %q must have a name and a URL", entry)
+	}
+	if err = checkCachePath("git_repo name", fields[0]); err != nil {
+		return "", "", nil, err
+	}
+	branches = fields[2:]
+	if len(branches) == 0 {
+		branches = []string{"master"}
+	}
+	return fields[0], fields[1], branches, nil
+}
+
+// Where a git repo is cached, relative to the barclamp's directory in
+// the cache.
+func gitRepoCachePath(name string) string {
+	return filepath.Join("git_repos", name+".git")
+}
+
+// Extras lists the things in extra_files and git_repo that need to be in
+// the cache at cacheDir.  extra_files entries that are not URLs are part
+// of the barclamp, so they are not included.
+//
+// Downloaded files are cached as barclamps/<barclamp>/files/<dest>/<file>,
+// where dest is the optional second field of the extra_files entry, and git
+// repos are cached as mirrors in barclamps/<barclamp>/git_repos/<name>.git.
+// Entries that would be cached outside of the barclamp's directory are
+// rejected.
+func (c *CrowbarYML) Extras(cacheDir string) ([]*Extra, error) {
+	if err := checkCacheName(c.Barclamp.Name); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(cacheDir, "barclamps", c.Barclamp.Name)
+	res := make([]*Extra, 0, len(c.ExtraFiles)+len(c.GitRepos))
+	for _, entry := range c.ExtraFiles {
+		file, dest, err := parseExtraFile(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Barclamp.Name, err)
+		}
+		if !strings.Contains(file, "://") {
+			continue
+		}
+		res = append(res, &Extra{
+			Barclamp: c.Barclamp.Name,
+			Kind:     "file",
+			Source:   file,
+			Path:     filepath.Join(base, extraFileCachePath(file, dest)),
+		})
+	}
+	for _, entry := range c.GitRepos {
+		name, url, branches, err := parseGitRepo(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.Barclamp.Name, err)
+		}
+		res = append(res, &Extra{
+			Barclamp: c.Barclamp.Name,
+			Kind:     "git_repo",
+			Source:   url,
+			Branches: branches,
+			Path:     filepath.Join(base, gitRepoCachePath(name)),
+		})
+	}
+	return res, nil
+}
+
+// Extras lists everything the barclamps in the set need in the cache,
+// in install order.
+func (m *MetadataSet) Extras(cacheDir string) ([]*Extra, error) {
+	res := make([]*Extra, 0)
+	for _, bc := range m.Sorted() {
+		extras, err := bc.Extras(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, extras...)
+	}
+	return res, nil
+}
+
+// Run git against a cached repo, killing it if ctx is cancelled.
+func cacheGit(ctx context.Context, gitDir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", gitDir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s in %s failed: %v\n%s", strings.Join(args, " "), gitDir, err, out)
+	}
+	return nil
+}
+
+// Check looks for the extra in the cache.  It only looks at the local
+// filesystem, so it works without the network.
+func (e *Extra) Check() {
+	e.MissingBranches = nil
+	_, err := os.Stat(e.Path)
+	e.Cached = err == nil
+	if !e.Cached || e.Kind != "git_repo" {
+		return
+	}
+	for _, branch := range e.Branches {
+		if cacheGit(context.Background(), e.Path, "rev-parse", "-q", "--verify", "refs/heads/"+branch+"^{commit}") != nil {
+			e.MissingBranches = append(e.MissingBranches, branch)
+		}
+	}
+	e.Cached = len(e.MissingBranches) == 0
+}
+
+// Download a file to dest, going through a temporary file so that an
+// interrupted download does not look like it is cached.  The download
+// is abandoned if ctx is cancelled.
+func fetchFile(ctx context.Context, url, dest string) error {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fetching %s failed: %s", url, resp.Status)
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".fetch-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Fetching %s failed: %v", url, err)
+	}
+	return nil
+}
+
+// Mirror a git repo into dest, going through a temporary directory so
+// that an interrupted clone does not look like it is cached.  The clone
+// is killed if ctx is cancelled.
+func cloneRepo(ctx context.Context, url, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), ".clone-")
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "git", "clone", "--mirror", url, tmp)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("Cloning %s failed: %v\n%s", url, err, out)
+	}
+	return nil
+}
+
+// Fetch puts the extra in the cache.  Files that are already cached are
+// left alone, and cached git repos are updated so that they pick up new
+// branches and commits.  Downloads are abandoned if ctx is cancelled.
+func (e *Extra) Fetch(ctx context.Context) error {
+	e.Check()
+	switch {
+	case e.Kind == "file" && e.Cached:
+		return nil
+	case e.Kind == "file":
+		if err := fetchFile(ctx, e.Source, e.Path); err != nil {
+			return err
+		}
+	case e.Cached || len(e.MissingBranches) > 0:
+		if err := cacheGit(ctx, e.Path, "fetch", "--prune", "origin"); err != nil {
+			return err
+		}
+	default:
+		if err := cloneRepo(ctx, e.Source, e.Path); err != nil {
+			return err
+		}
+	}
+	e.Check()
+	if !e.Cached {
+		return fmt.Errorf("%s is missing branches %s after fetching", e.Source, strings.Join(e.MissingBranches, ", "))
+	}
+	return nil
+}
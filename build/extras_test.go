@@ -0,0 +1,105 @@
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtras(t *testing.T) {
+	tests := []struct {
+		name       string
+		barclamp   string
+		extraFiles []string
+		gitRepos   []string
+		paths      []string
+		err        string
+	}{
+		{
+			name:       "files and repos are cached under the barclamp",
+			barclamp:   "chef",
+			extraFiles: []string{"http://example.com/a/chef.tgz pkgs", "http://example.com/b.tgz", "local/file"},
+			gitRepos:   []string{"cookbooks http://example.com/cookbooks.git"},
+			paths: []string{
+				"barclamps/chef/files/pkgs/chef.tgz",
+				"barclamps/chef/files/b.tgz",
+				"barclamps/chef/git_repos/cookbooks.git",
+			},
+		},
+		{
+			name:       "destinations cannot climb out of the cache",
+			barclamp:   "chef",
+			extraFiles: []string{"http://example.com/chef.tgz ../../.."},
+			err:        "must not contain ..",
+		},
+		{
+			name:       "destinations cannot be absolute",
+			barclamp:   "chef",
+			extraFiles: []string{"http://example.com/chef.tgz /etc"},
+			err:        "must be a relative path",
+		},
+		{
+			name:     "repo names cannot climb out of the cache",
+			barclamp: "chef",
+			gitRepos: []string{"../foo http://example.com/foo.git"},
+			err:      "must not contain ..",
+		},
+		{
+			name:     "barclamp names must be a single directory",
+			barclamp: "..",
+			gitRepos: []string{"foo http://example.com/foo.git"},
+			err:      "cannot be used as a directory name",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &CrowbarYML{
+				Barclamp:   &BarclampSection{Name: test.barclamp},
+				ExtraFiles: test.extraFiles,
+				GitRepos:   test.gitRepos,
+			}
+			extras, err := c.Extras("/cache")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if len(extras) != len(test.paths) {
+				t.Fatalf("Expected %d extras, got %d", len(test.paths), len(extras))
+			}
+			for i, extra := range extras {
+				if expected := filepath.Join("/cache", test.paths[i]); extra.Path != expected {
+					t.Errorf("Expected extra %d to be cached at %s, got %s", i, expected, extra.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestLintDuplicateCachePaths(t *testing.T) {
+	src := &Source{
+		Path: "chef/crowbar.yml",
+		Data: []byte(`barclamp:
+  name: chef
+extra_files:
+  - http://example.com/a/chef.tgz
+  - http://example.com/b/chef.tgz
+git_repo:
+  - cookbooks http://example.com/cookbooks.git
+  - cookbooks http://example.com/other.git
+`),
+	}
+	problems := LintSources([]*Source{src})
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", problems)
+	}
+	for i, line := range []int{5, 8} {
+		if problems[i].Line != line || !strings.Contains(problems[i].Message, "the same place as") {
+			t.Errorf("Expected a duplicate cache path on line %d, got %v", line, problems[i])
+		}
+	}
+}
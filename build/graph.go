@@ -0,0 +1,151 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GraphNode is a barclamp or a group in a dependency graph.
+type GraphNode struct {
+	Name string `json:"name"`
+	// Either "barclamp" or "group".
+	Kind string `json:"kind"`
+	// True if something refers to this barclamp, but it is not in the build,
+	// or if this is a group that nothing in the build is a member of.
+	Missing bool `json:"missing"`
+}
+
+// GraphEdge is a relationship between two nodes in a dependency graph.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// "requires" if From requires To, "member" if group From has To
+	// as a member, or "supercedes" if From supercedes To.
+	Kind string `json:"kind"`
+}
+
+// DepGraph is the dependency graph of the barclamps in a build, as
+// declared by the requires, member, and supercedes directives in their
+// crowbar.yml files.  Unlike LoadMetadata, nothing is expanded or
+// substituted, so the graph shows what the metadata actually says.
+type DepGraph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+// The name we use for a group node, so that it cannot collide with a barclamp.
+func groupNode(name string) string {
+	return "@" + strings.TrimPrefix(name, "@")
+}
+
+// LoadGraph builds the dependency graph for the crowbar.yml files in srcs.
+// missing lists barclamps that are part of the build but that we do not
+// have metadata for.
+func LoadGraph(srcs []*Source, missing []string) (*DepGraph, error) {
+	nodes := make(map[string]*GraphNode)
+	res := &DepGraph{Edges: make([]*GraphEdge, 0)}
+	metas := make([]*CrowbarYML, 0, len(srcs))
+	for _, src := range srcs {
+		bc, err := parseMeta(src.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.Path, err)
+		}
+		metas = append(metas, bc)
+		nodes[bc.Barclamp.Name] = &GraphNode{Name: bc.Barclamp.Name, Kind: "barclamp"}
+	}
+	for _, name := range missing {
+		nodes[name] = &GraphNode{Name: name, Kind: "barclamp", Missing: true}
+	}
+	// Add a node for something we only know about because it was referred to.
+	refer := func(name, kind string) {
+		if _, found := nodes[name]; !found {
+			nodes[name] = &GraphNode{Name: name, Kind: kind, Missing: true}
+		}
+	}
+	for _, bc := range metas {
+		name := bc.Barclamp.Name
+		for _, req := range bc.Barclamp.Requires {
+			if strings.HasPrefix(req, "@") {
+				refer(groupNode(req), "group")
+				req = groupNode(req)
+			} else {
+				refer(req, "barclamp")
+			}
+			res.Edges = append(res.Edges, &GraphEdge{From: name, To: req, Kind: "requires"})
+		}
+		for _, member := range bc.Barclamp.Member {
+			grp := groupNode(member)
+			if node, found := nodes[grp]; found {
+				node.Missing = false
+			} else {
+				nodes[grp] = &GraphNode{Name: grp, Kind: "group"}
+			}
+			res.Edges = append(res.Edges, &GraphEdge{From: grp, To: name, Kind: "member"})
+		}
+		for _, victim := range bc.Barclamp.Supercedes {
+			// A superceded barclamp is supposed to be absent,
+			// so it does not count as missing.
+			if _, found := nodes[victim]; !found {
+				nodes[victim] = &GraphNode{Name: victim, Kind: "barclamp"}
+			}
+			res.Edges = append(res.Edges, &GraphEdge{From: name, To: victim, Kind: "supercedes"})
+		}
+	}
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res.Nodes = make([]*GraphNode, 0, len(names))
+	for _, name := range names {
+		res.Nodes = append(res.Nodes, nodes[name])
+	}
+	sort.Slice(res.Edges, func(i, j int) bool {
+		a, b := res.Edges[i], res.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.To < b.To
+	})
+	return res, nil
+}
+
+// DOT renders the graph in Graphviz format.  Groups are drawn as ellipses,
+// missing barclamps and empty groups are drawn in red, group membership is
+// drawn with dashed lines, and supercedes with dotted lines.
+func (g *DepGraph) DOT(name string) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "digraph %q {\n", name)
+	fmt.Fprintf(buf, "\tnode [shape=box];\n")
+	for _, node := range g.Nodes {
+		attrs := make([]string, 0, 3)
+		if node.Kind == "group" {
+			attrs = append(attrs, "shape=ellipse")
+		}
+		if node.Missing {
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(buf, "\t%q;\n", node.Name)
+		} else {
+			fmt.Fprintf(buf, "\t%q [%s];\n", node.Name, strings.Join(attrs, ", "))
+		}
+	}
+	for _, edge := range g.Edges {
+		switch edge.Kind {
+		case "member":
+			fmt.Fprintf(buf, "\t%q -> %q [style=dashed];\n", edge.From, edge.To)
+		case "supercedes":
+			fmt.Fprintf(buf, "\t%q -> %q [style=dotted, label=\"supercedes\"];\n", edge.From, edge.To)
+		default:
+			fmt.Fprintf(buf, "\t%q -> %q;\n", edge.From, edge.To)
+		}
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
@@ -0,0 +1,357 @@
+package build
+
+import (
+	"fmt"
+	"launchpad.net/goyaml"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem is something wrong with a crowbar.yml file.
+type Problem struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (p *Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.Path, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// Problems is a list of everything wrong with a set of crowbar.yml files.
+type Problems []*Problem
+
+func (p Problems) Len() int {
+	return len(p)
+}
+
+func (p Problems) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (p Problems) Less(i, j int) bool {
+	if p[i].Path != p[j].Path {
+		return p[i].Path < p[j].Path
+	}
+	return p[i].Line < p[j].Line
+}
+
+// The keys we expect at the top level of crowbar.yml.
+var knownTopKeys = map[string]bool{
+	"barclamp":         true,
+	"crowbar":          true,
+	"nav":              true,
+	"debs":             true,
+	"rpms":             true,
+	"gems":             true,
+	"extra_files":      true,
+	"git_repo":         true,
+	"locale_additions": true,
+	"smoketest":        true,
+	"roles":            true,
+	"jigs":             true,
+	"attribs":          true,
+	"wizard":           true,
+}
+
+// The keys we expect in the barclamp section of crowbar.yml.
+var knownBarclampKeys = map[string]bool{
+	"name":                    true,
+	"display":                 true,
+	"description":             true,
+	"online_help":             true,
+	"version":                 true,
+	"member":                  true,
+	"supercedes":              true,
+	"requires":                true,
+	"os_support":              true,
+	"user_managed":            true,
+	"license":                 true,
+	"copyright":               true,
+	"proposal_schema_version": true,
+	"api_version":             true,
+	"api_version_accepted":    true,
+}
+
+// yamlLines remembers which line each key and list item in a YAML
+// file is on, since goyaml does not tell us.  Keys are dotted paths
+// like barclamp.name, and list items are like barclamp.requires[2].
+type yamlLines map[string]int
+
+var yamlKeyRE = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"][^:]*?):(\s|$)`)
+
+// Index the lines of a YAML file.  This only understands the block style
+// mappings and lists that crowbar.yml files use, which is all we need to
+// point people at the right line.
+func indexYAMLLines(data []byte) yamlLines {
+	type level struct {
+		indent int
+		path   string
+	}
+	res := make(yamlLines)
+	counts := make(map[string]int)
+	stack := make([]level, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		content := strings.TrimLeft(line, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		indent := len(line) - len(content)
+		if strings.HasPrefix(content, "- ") || content == "-" {
+			// List items can be at the same indent as their key.
+			for len(stack) > 0 && stack[len(stack)-1].indent > indent {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				continue
+			}
+			parent := stack[len(stack)-1].path
+			res[fmt.Sprintf("%s[%d]", parent, counts[parent])] = lineNo
+			counts[parent]++
+			continue
+		}
+		match := yamlKeyRE.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		key := strings.Trim(match[1], `"'`)
+		path := key
+		if len(stack) > 0 {
+			path = stack[len(stack)-1].path + "." + key
+		}
+		res[path] = lineNo
+		stack = append(stack, level{indent: indent, path: path})
+	}
+	return res
+}
+
+// Find the line for path, or for the closest thing containing it.
+func (l yamlLines) find(path string) int {
+	for path != "" {
+		if line, found := l[path]; found {
+			return line
+		}
+		if idx := strings.LastIndexAny(path, ".["); idx != -1 {
+			path = path[:idx]
+		} else {
+			break
+		}
+	}
+	return 0
+}
+
+var yamlErrLineRE = regexp.MustCompile(`line (\d+)`)
+
+// lintFile is everything we learned from linting one crowbar.yml.
+type lintFile struct {
+	path  string
+	lines yamlLines
+	meta  *CrowbarYML
+}
+
+// Record a problem at the line for key.
+func (f *lintFile) problem(res Problems, key, format string, args ...interface{}) Problems {
+	return append(res, &Problem{
+		Path:    f.path,
+		Line:    f.lines.find(key),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check the keys of a debs or rpms section.
+func (f *lintFile) lintPackageSection(res Problems, name string, raw interface{}) Problems {
+	sect, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return f.problem(res, name, "%s must be a mapping", name)
+	}
+	for k, v := range sect {
+		key := fmt.Sprint(k)
+		if basePackageKeys[key] {
+			continue
+		}
+		osSect, ok := v.(map[interface{}]interface{})
+		if !ok {
+			res = f.problem(res, name+"."+key, "%s.%s must be a mapping", name, key)
+			continue
+		}
+		for osKey := range osSect {
+			if !basePackageKeys[fmt.Sprint(osKey)] {
+				res = f.problem(res, name+"."+key+"."+fmt.Sprint(osKey), "%s.%s has unknown key %v", name, key, osKey)
+			}
+		}
+	}
+	return res
+}
+
+// Check a single crowbar.yml file.  This returns everything we learned
+// about it, including the parsed metadata if the file could be parsed at
+// all, along with everything wrong with it that can be found by looking
+// at it on its own.
+func lintOne(src *Source) (*lintFile, Problems) {
+	path, data := src.Path, src.Data
+	f := &lintFile{path: path, lines: indexYAMLLines(data)}
+	res := make(Problems, 0)
+	raw := make(map[string]interface{})
+	if err := goyaml.Unmarshal(data, &raw); err != nil {
+		line := 0
+		if match := yamlErrLineRE.FindStringSubmatch(err.Error()); match != nil {
+			line, _ = strconv.Atoi(match[1])
+		}
+		return f, append(res, &Problem{Path: path, Line: line, Message: err.Error()})
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !knownTopKeys[key] {
+			res = f.problem(res, key, "Unknown key %s", key)
+		}
+	}
+	bcRaw, ok := raw["barclamp"].(map[interface{}]interface{})
+	if !ok {
+		return f, f.problem(res, "barclamp", "Missing or malformed barclamp section")
+	}
+	for k := range bcRaw {
+		if !knownBarclampKeys[fmt.Sprint(k)] {
+			res = f.problem(res, "barclamp."+fmt.Sprint(k), "Unknown key barclamp.%v", k)
+		}
+	}
+	if name, ok := bcRaw["name"].(string); !ok || name == "" {
+		res = f.problem(res, "barclamp.name", "barclamp.name is required")
+	} else if err := checkCacheName(name); err != nil {
+		res = f.problem(res, "barclamp.name", "%v", err)
+	}
+	if version, found := bcRaw["version"]; found {
+		switch version.(type) {
+		case int, int64:
+		default:
+			res = f.problem(res, "barclamp.version", "barclamp.version must be an integer, not %v", version)
+		}
+	}
+	for _, sect := range []string{"debs", "rpms"} {
+		if sectRaw, found := raw[sect]; found {
+			res = f.lintPackageSection(res, sect, sectRaw)
+		}
+	}
+	meta := &CrowbarYML{}
+	if err := goyaml.Unmarshal(data, meta); err != nil {
+		// If we already found problems, this is most likely
+		// one of them, so don't report it twice.
+		if len(res) == 0 {
+			res = f.problem(res, "", "%v", err)
+		}
+		return f, res
+	}
+	if meta.Barclamp == nil {
+		return f, res
+	}
+	if err := meta.loadOSSections(data); err != nil && len(res) == 0 {
+		res = f.problem(res, "", "%v", err)
+	}
+	for _, problem := range meta.osProblems() {
+		res = f.problem(res, problem.section+"."+problem.os, "%s", problem.message)
+	}
+	// Downloaded extras that would land in the same place in the
+	// build cache would overwrite each other.
+	cached := make(map[string]string)
+	cachedAt := func(key, where string) {
+		if other, found := cached[where]; found {
+			res = f.problem(res, key, "%s would be cached at %s, the same place as %s", key, where, other)
+			return
+		}
+		cached[where] = key
+	}
+	for i, extra := range meta.ExtraFiles {
+		key := fmt.Sprintf("extra_files[%d]", i)
+		file, dest, err := parseExtraFile(extra)
+		if err != nil {
+			res = f.problem(res, key, "%v", err)
+			continue
+		}
+		// URLs get fetched into the build cache, so we can only
+		// check files that are supposed to be in the barclamp.
+		if strings.Contains(file, "://") {
+			cachedAt(key, extraFileCachePath(file, dest))
+			continue
+		}
+		if !src.exists(file) {
+			res = f.problem(res, key, "extra file %s does not exist", file)
+		}
+	}
+	for i, repo := range meta.GitRepos {
+		key := fmt.Sprintf("git_repo[%d]", i)
+		name, _, _, err := parseGitRepo(repo)
+		if err != nil {
+			res = f.problem(res, key, "%v", err)
+			continue
+		}
+		cachedAt(key, gitRepoCachePath(name))
+	}
+	f.meta = meta
+	return f, res
+}
+
+// LintSources checks all the crowbar.yml files in srcs, and returns every
+// problem it finds with them.  In addition to checking each file on its
+// own, this makes sure that barclamp names are unique, and that requires
+// directives refer to barclamps and groups that exist.
+func LintSources(srcs []*Source) Problems {
+	res := make(Problems, 0)
+	files := make([]*lintFile, 0, len(srcs))
+	for _, src := range srcs {
+		f, problems := lintOne(src)
+		res = append(res, problems...)
+		if f.meta != nil && f.meta.Barclamp.Name != "" {
+			files = append(files, f)
+		}
+	}
+	res = append(res, lintCrossFile(files)...)
+	sort.Stable(res)
+	return res
+}
+
+// Check the things that need all the crowbar.yml files at once.
+func lintCrossFile(files []*lintFile) Problems {
+	res := make(Problems, 0)
+	names := make(map[string]string)
+	groups := make(map[string]bool)
+	superceded := make(map[string]bool)
+	for _, f := range files {
+		name := f.meta.Barclamp.Name
+		if other, found := names[name]; found {
+			res = f.problem(res, "barclamp.name", "barclamp %s is also defined in %s", name, other)
+		}
+		names[name] = f.path
+		for _, member := range f.meta.Barclamp.Member {
+			groups[strings.TrimPrefix(member, "@")] = true
+		}
+		for _, victim := range f.meta.Barclamp.Supercedes {
+			superceded[victim] = true
+		}
+	}
+	for _, f := range files {
+		for i, req := range f.meta.Barclamp.Requires {
+			key := fmt.Sprintf("barclamp.requires[%d]", i)
+			switch {
+			case strings.HasPrefix(req, "@"):
+				if !groups[strings.TrimPrefix(req, "@")] {
+					res = f.problem(res, key, "requires group %s, which has no members", req)
+				}
+			case names[req] == "" && !superceded[req]:
+				res = f.problem(res, key, "requires %s, which is not in the build", req)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,290 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"launchpad.net/goyaml"
+	"sort"
+	"strings"
+)
+
+// The keys in a debs or rpms section that are not OS names.
+var basePackageKeys = map[string]bool{
+	"repos":      true,
+	"pkgs":       true,
+	"build_pkgs": true,
+}
+
+// Pick the OS specific sections out of the debs and rpms sections of
+// a crowbar.yml file.  goyaml cannot put the leftover keys of a mapping
+// into a map for us, so we load the sections generically and
+// unmarshal each OS section on its own.
+func (c *CrowbarYML) loadOSSections(data []byte) error {
+	raw := struct {
+		Debs map[string]interface{}
+		Rpms map[string]interface{}
+	}{}
+	if err := goyaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for _, sect := range []struct {
+		name string
+		raw  map[string]interface{}
+		dest **OSPackagesSection
+	}{{"debs", raw.Debs, &c.Debs}, {"rpms", raw.Rpms, &c.Rpms}} {
+		if sect.raw == nil {
+			continue
+		}
+		if *sect.dest == nil {
+			*sect.dest = &OSPackagesSection{}
+		}
+		(*sect.dest).OS = make(map[string]*PackagesSection)
+		for os, val := range sect.raw {
+			if basePackageKeys[os] {
+				continue
+			}
+			buf, err := goyaml.Marshal(val)
+			if err != nil {
+				return err
+			}
+			pkgs := &PackagesSection{}
+			if err = goyaml.Unmarshal(buf, pkgs); err != nil {
+				return fmt.Errorf("%s section %s: %v", sect.name, os, err)
+			}
+			(*sect.dest).OS[os] = pkgs
+		}
+	}
+	return nil
+}
+
+// The packaging sections (debs or rpms) that a barclamp has OS specific
+// packages for os in.
+func (c *CrowbarYML) osPackaging(os string) []string {
+	res := make([]string, 0, 1)
+	if c.Debs != nil && c.Debs.OS[os] != nil {
+		res = append(res, "debs")
+	}
+	if c.Rpms != nil && c.Rpms.OS[os] != nil {
+		res = append(res, "rpms")
+	}
+	return res
+}
+
+// Figure out which packaging section (debs or rpms) an OS uses from the
+// sections the barclamps in the set list it under, so that any OS works
+// as long as the metadata agrees on how it is packaged.  If nothing has
+// OS specific packages for it, we go by which sections the barclamps that
+// list it in os_support have.
+func (m *MetadataSet) osPackaging(os string) (string, error) {
+	found := make(map[string][]string)
+	for _, name := range m.names() {
+		for _, packaging := range m.Barclamps[name].osPackaging(os) {
+			found[packaging] = append(found[packaging], name)
+		}
+	}
+	if len(found) == 0 {
+		for _, name := range m.names() {
+			bc := m.Barclamps[name]
+			if len(bc.Barclamp.OsSupport) == 0 || !bc.supports(os) {
+				continue
+			}
+			if bc.Debs != nil {
+				found["debs"] = append(found["debs"], name)
+			}
+			if bc.Rpms != nil {
+				found["rpms"] = append(found["rpms"], name)
+			}
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return "", fmt.Errorf("No barclamp has debs or rpms packages for %s, cannot tell how it is packaged", os)
+	case len(found) > 1:
+		return "", fmt.Errorf("%s has debs packages in %s, and rpms packages in %s",
+			os, strings.Join(found["debs"], ", "), strings.Join(found["rpms"], ", "))
+	case len(found["debs"]) > 0:
+		return "debs", nil
+	}
+	return "rpms", nil
+}
+
+// Get the base and OS-specific package sections for an OS that uses
+// packaging.  Either one can be nil if the barclamp does not have it.
+func (c *CrowbarYML) osPackages(os, packaging string) (base, specific *PackagesSection) {
+	sect := c.Debs
+	if packaging == "rpms" {
+		sect = c.Rpms
+	}
+	if sect == nil {
+		return nil, nil
+	}
+	return &sect.PackagesSection, sect.OS[os]
+}
+
+// Whether a barclamp lists os in its os_support.
+// A barclamp without an os_support supports everything.
+func (c *CrowbarYML) supports(os string) bool {
+	if len(c.Barclamp.OsSupport) == 0 {
+		return true
+	}
+	for _, supported := range c.Barclamp.OsSupport {
+		if supported == os {
+			return true
+		}
+	}
+	return false
+}
+
+// osProblem is an OS specific package section that does not make sense.
+type osProblem struct {
+	section, os, message string
+}
+
+// Find all the OS specific package sections that are for an OS that
+// the barclamp does not list in os_support, and OSes that have packages
+// in both the debs and rpms sections.
+func (c *CrowbarYML) osProblems() []osProblem {
+	res := make([]osProblem, 0)
+	for _, sect := range []struct {
+		name string
+		pkgs *OSPackagesSection
+	}{{"debs", c.Debs}, {"rpms", c.Rpms}} {
+		if sect.pkgs == nil {
+			continue
+		}
+		oses := make([]string, 0, len(sect.pkgs.OS))
+		for os := range sect.pkgs.OS {
+			oses = append(oses, os)
+		}
+		sort.Strings(oses)
+		for _, os := range oses {
+			if !c.supports(os) {
+				res = append(res, osProblem{sect.name, os,
+					fmt.Sprintf("%s has packages for %s, which is not in os_support", sect.name, os)})
+			}
+			if sect.name == "rpms" && len(c.osPackaging(os)) > 1 {
+				res = append(res, osProblem{sect.name, os,
+					fmt.Sprintf("%s has packages in both debs and rpms", os)})
+			}
+		}
+	}
+	return res
+}
+
+// CheckOSSupport makes sure that every OS specific section in the debs
+// and rpms sections is for an OS that the barclamp lists in os_support,
+// and that it is in the right section for that OS.
+func (c *CrowbarYML) CheckOSSupport() error {
+	problems := c.osProblems()
+	if len(problems) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		msgs = append(msgs, problem.message)
+	}
+	return fmt.Errorf("%s: %s", c.Barclamp.Name, strings.Join(msgs, "; "))
+}
+
+// OSMatrix shows which barclamps in a build support which operating systems.
+type OSMatrix struct {
+	// Every OS that any barclamp mentions, sorted.
+	OSes []string `json:"oses"`
+	// The barclamps in the build, sorted.
+	Barclamps []string `json:"barclamps"`
+	// Support[barclamp][os] is true if the barclamp lists os in os_support,
+	// or if it has no os_support at all.
+	Support map[string]map[string]bool `json:"support"`
+	// Packages[barclamp][os] is true if the barclamp has OS-specific
+	// packages for os.
+	Packages map[string]map[string]bool `json:"packages"`
+}
+
+// OSSupportMatrix works out which operating systems each barclamp with
+// a crowbar.yml in srcs supports and has packages for.
+func OSSupportMatrix(srcs []*Source) (*OSMatrix, error) {
+	res := &OSMatrix{
+		OSes:      make([]string, 0),
+		Barclamps: make([]string, 0, len(srcs)),
+		Support:   make(map[string]map[string]bool),
+		Packages:  make(map[string]map[string]bool),
+	}
+	seen := make(map[string]bool)
+	unrestricted := make([]string, 0)
+	addOS := func(os string) {
+		if !seen[os] {
+			seen[os] = true
+			res.OSes = append(res.OSes, os)
+		}
+	}
+	for _, src := range srcs {
+		bc, err := parseMeta(src.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.Path, err)
+		}
+		name := bc.Barclamp.Name
+		res.Barclamps = append(res.Barclamps, name)
+		res.Support[name] = make(map[string]bool)
+		res.Packages[name] = make(map[string]bool)
+		if len(bc.Barclamp.OsSupport) == 0 {
+			unrestricted = append(unrestricted, name)
+		}
+		for _, os := range bc.Barclamp.OsSupport {
+			addOS(os)
+			res.Support[name][os] = true
+		}
+		for _, sect := range []*OSPackagesSection{bc.Debs, bc.Rpms} {
+			if sect == nil {
+				continue
+			}
+			for os := range sect.OS {
+				addOS(os)
+				res.Packages[name][os] = true
+			}
+		}
+	}
+	for _, name := range unrestricted {
+		for _, os := range res.OSes {
+			res.Support[name][os] = true
+		}
+	}
+	sort.Strings(res.OSes)
+	sort.Strings(res.Barclamps)
+	return res, nil
+}
+
+// String renders the matrix as a table.  A barclamp that supports an OS
+// gets a Y, and a P if it also has OS-specific packages for it.
+// A ! marks packages for an OS that is not in os_support.
+func (m *OSMatrix) String() string {
+	width := len("barclamp")
+	for _, name := range m.Barclamps {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%-*s", width, "barclamp")
+	for _, os := range m.OSes {
+		fmt.Fprintf(buf, "  %s", os)
+	}
+	buf.WriteString("\n")
+	for _, name := range m.Barclamps {
+		row := &bytes.Buffer{}
+		fmt.Fprintf(row, "%-*s", width, name)
+		for _, os := range m.OSes {
+			cell := ""
+			switch {
+			case m.Support[name][os] && m.Packages[name][os]:
+				cell = "YP"
+			case m.Support[name][os]:
+				cell = "Y"
+			case m.Packages[name][os]:
+				cell = "!"
+			}
+			fmt.Fprintf(row, "  %-*s", len(os), cell)
+		}
+		buf.WriteString(strings.TrimRight(row.String(), " ") + "\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,72 @@
+package build
+
+// Manifest is the merged list of everything that needs to be in the
+// package cache to build an ISO for a set of barclamps on one OS.
+type Manifest struct {
+	OS string `yaml:"os" json:"os"`
+	// The barclamps that went into the manifest, in dependency order.
+	Barclamps     []string `yaml:"barclamps" json:"barclamps"`
+	Repos         []string `yaml:"repos" json:"repos"`
+	Packages      []string `yaml:"pkgs" json:"pkgs"`
+	BuildPackages []string `yaml:"build_pkgs" json:"build_pkgs"`
+	GemRepos      []string `yaml:"gem_repos" json:"gem_repos"`
+	Gems          []string `yaml:"gems" json:"gems"`
+	BuildGems     []string `yaml:"build_gems" json:"build_gems"`
+}
+
+// Append the items in src that are not already in dest, keeping the order.
+func appendUnique(dest []string, seen map[string]bool, src []string) []string {
+	for _, item := range src {
+		if !seen[item] {
+			seen[item] = true
+			dest = append(dest, item)
+		}
+	}
+	return dest
+}
+
+// PackageManifest merges the package requirements of the barclamps in
+// the set for os.  The base and OS-specific repos, pkgs, and build_pkgs
+// of each barclamp are merged in dependency order, along with the gems,
+// and duplicates are dropped.  Barclamps whose os_support does not
+// include os are left out.  Whether os uses debs or rpms comes from
+// the section the barclamps list its OS specific packages in.
+func (m *MetadataSet) PackageManifest(os string) (*Manifest, error) {
+	packaging, err := m.osPackaging(os)
+	if err != nil {
+		return nil, err
+	}
+	res := &Manifest{
+		OS:            os,
+		Barclamps:     make([]string, 0, len(m.Order)),
+		Repos:         make([]string, 0),
+		Packages:      make([]string, 0),
+		BuildPackages: make([]string, 0),
+		GemRepos:      make([]string, 0),
+		Gems:          make([]string, 0),
+		BuildGems:     make([]string, 0),
+	}
+	seenRepos, seenPkgs, seenBuildPkgs := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	seenGemRepos, seenGems, seenBuildGems := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	for _, bc := range m.Sorted() {
+		if !bc.supports(os) {
+			continue
+		}
+		res.Barclamps = append(res.Barclamps, bc.Barclamp.Name)
+		base, specific := bc.osPackages(os, packaging)
+		for _, sect := range []*PackagesSection{base, specific} {
+			if sect == nil {
+				continue
+			}
+			res.Repos = appendUnique(res.Repos, seenRepos, sect.Repos)
+			res.Packages = appendUnique(res.Packages, seenPkgs, sect.Packages)
+			res.BuildPackages = appendUnique(res.BuildPackages, seenBuildPkgs, sect.BuildPackages)
+		}
+		if bc.Gems != nil {
+			res.GemRepos = appendUnique(res.GemRepos, seenGemRepos, bc.Gems.Repos)
+			res.Gems = appendUnique(res.Gems, seenGems, bc.Gems.Packages)
+			res.BuildGems = appendUnique(res.BuildGems, seenBuildGems, bc.Gems.BuildPackages)
+		}
+	}
+	return res, nil
+}
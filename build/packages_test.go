@@ -0,0 +1,87 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A barclamp with debs packages, supporting the OSes in support.
+func withDebs(name string, base []string, specific map[string][]string, support ...string) *CrowbarYML {
+	debs := &OSPackagesSection{
+		PackagesSection: PackagesSection{Packages: base},
+		OS:              make(map[string]*PackagesSection),
+	}
+	for os, pkgs := range specific {
+		debs.OS[os] = &PackagesSection{Packages: pkgs}
+	}
+	return &CrowbarYML{
+		Barclamp: &BarclampSection{Name: name, OsSupport: support},
+		Debs:     debs,
+	}
+}
+
+func TestPackageManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		barclamps []*CrowbarYML
+		os        string
+		included  []string
+		packages  []string
+		fails     bool
+	}{
+		{
+			name: "base and OS packages are merged in order without duplicates",
+			barclamps: []*CrowbarYML{
+				withDebs("crowbar", []string{"ruby", "git"}, map[string][]string{"ubuntu-12.04": {"ruby1.9"}}),
+				withDebs("nova", []string{"git", "kvm"}, nil),
+			},
+			os:       "ubuntu-12.04",
+			included: []string{"crowbar", "nova"},
+			packages: []string{"ruby", "git", "ruby1.9", "kvm"},
+		},
+		{
+			name: "barclamps that do not support the OS are left out",
+			barclamps: []*CrowbarYML{
+				withDebs("crowbar", []string{"ruby"}, map[string][]string{"ubuntu-12.04": {"ruby1.9"}}),
+				withDebs("hyperv", []string{"winrm"}, nil, "windows"),
+				withDebs("nova", []string{"kvm"}, nil, "ubuntu-12.04"),
+			},
+			os:       "ubuntu-12.04",
+			included: []string{"crowbar", "nova"},
+			packages: []string{"ruby", "ruby1.9", "kvm"},
+		},
+		{
+			name: "unknown packaging",
+			barclamps: []*CrowbarYML{
+				withDebs("crowbar", []string{"ruby"}, nil),
+			},
+			os:    "ubuntu-12.04",
+			fails: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := &MetadataSet{Barclamps: make(map[string]*CrowbarYML)}
+			for _, bc := range test.barclamps {
+				set.Barclamps[bc.Barclamp.Name] = bc
+				set.Order = append(set.Order, bc.Barclamp.Name)
+			}
+			manifest, err := set.PackageManifest(test.os)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", manifest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(manifest.Barclamps, test.included) {
+				t.Errorf("Expected barclamps %v, got %v", test.included, manifest.Barclamps)
+			}
+			if !reflect.DeepEqual(manifest.Packages, test.packages) {
+				t.Errorf("Expected packages %v, got %v", test.packages, manifest.Packages)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Source is the contents of a crowbar.yml file, along with where it
+// came from.  This lets us check crowbar.yml files that are not in
+// a working tree, such as ones read straight out of a git branch.
+type Source struct {
+	// Where the file came from, for use in messages.
+	Path string
+	// The contents of the file.
+	Data []byte
+	// Exists reports whether a file relative to the top of the
+	// barclamp exists.  If it is nil, we look next to Path on disk.
+	Exists func(name string) bool
+}
+
+// ReadSource reads a crowbar.yml file from disk.
+func ReadSource(path string) (*Source, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{Path: path, Data: data}, nil
+}
+
+// Parse parses (but does not process) the crowbar.yml file.
+func (s *Source) Parse() (*CrowbarYML, error) {
+	res, err := parseMeta(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return res, nil
+}
+
+// Whether a file relative to the top of the barclamp exists.
+func (s *Source) exists(name string) bool {
+	if s.Exists != nil {
+		return s.Exists(name)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(s.Path), name))
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CycleError is returned by Toposort when barclamps depend on each other.
+// Path is the cycle, starting and ending with the same barclamp.
+type CycleError struct {
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return "Dependency cycle: " + strings.Join(e.Path, " -> ")
+}
+
+// MissingDependencyError is returned by Toposort when a barclamp
+// requires a barclamp we do not have metadata for.
+type MissingDependencyError struct {
+	Barclamp, Requires string
+}
+
+func (e *MissingDependencyError) Error() string {
+	return fmt.Sprintf("%s requires %s, which does not exist", e.Barclamp, e.Requires)
+}
+
+// Get the names of the barclamps that a barclamp depends on.
+// Group requirements must already be expanded.
+// Everyone who is not crowbar gets a free dependency on crowbar if
+// it is one of the barclamps we are sorting.
+func requirements(name string, metadata map[string]*CrowbarYML) []string {
+	res := make([]string, 0, len(metadata[name].Barclamp.Requires)+1)
+	seen := make(map[string]bool)
+	if _, found := metadata["crowbar"]; found && name != "crowbar" {
+		res = append(res, "crowbar")
+		seen["crowbar"] = true
+	}
+	for _, req := range metadata[name].Barclamp.Requires {
+		if !seen[req] {
+			res = append(res, req)
+			seen[req] = true
+		}
+	}
+	return res
+}
+
+// Toposort orders barclamps so that every barclamp comes after
+// everything it requires, using Kahn's algorithm.  Group requirements
+// must already be expanded.  Barclamps that are not ordered relative to
+// each other are sorted by name, so the result is always the same for
+// the same metadata.
+//
+// If a barclamp requires one we do not know about, a
+// *MissingDependencyError is returned.  If there is a dependency cycle,
+// a *CycleError with the full cycle is returned.
+func Toposort(metadata map[string]*CrowbarYML) ([]string, error) {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// How many unsatisfied requirements each barclamp has, and
+	// which barclamps are waiting on each barclamp.
+	inDegree := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, name := range names {
+		reqs := requirements(name, metadata)
+		for _, req := range reqs {
+			if _, found := metadata[req]; !found {
+				return nil, &MissingDependencyError{Barclamp: name, Requires: req}
+			}
+			dependents[req] = append(dependents[req], name)
+		}
+		inDegree[name] = len(reqs)
+	}
+	ready := make([]string, 0, len(names))
+	for _, name := range names {
+		if inDegree[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	res := make([]string, 0, len(names))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		res = append(res, name)
+		for _, dependent := range dependents[name] {
+			inDegree[dependent]--
+			if inDegree[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(res) == len(names) {
+		return res, nil
+	}
+	// Everything left over is in or behind a cycle.
+	return nil, &CycleError{Path: findCycle(names, inDegree, metadata)}
+}
+
+// Find a cycle among the barclamps that Toposort could not order.
+// Every one of them has an unsatisfied requirement that is also
+// left over, so walking those requirements must eventually loop.
+func findCycle(names []string, inDegree map[string]int, metadata map[string]*CrowbarYML) []string {
+	var start string
+	for _, name := range names {
+		if inDegree[name] > 0 {
+			start = name
+			break
+		}
+	}
+	path := make([]string, 0)
+	seenAt := make(map[string]int)
+	for name := start; ; {
+		if idx, seen := seenAt[name]; seen {
+			return append(path[idx:], name)
+		}
+		seenAt[name] = len(path)
+		path = append(path, name)
+		for _, req := range requirements(name, metadata) {
+			if inDegree[req] > 0 {
+				name = req
+				break
+			}
+		}
+	}
+}
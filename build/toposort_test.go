@@ -0,0 +1,102 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A barclamp that requires other barclamps, and nothing else.
+func requiring(name string, requires ...string) *CrowbarYML {
+	return &CrowbarYML{Barclamp: &BarclampSection{Name: name, Requires: requires}}
+}
+
+func TestToposort(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]*CrowbarYML
+		order    []string
+		cycle    []string
+		missing  *MissingDependencyError
+	}{
+		{
+			name: "requirements come first",
+			metadata: map[string]*CrowbarYML{
+				"a": requiring("a", "b"),
+				"b": requiring("b", "c"),
+				"c": requiring("c"),
+			},
+			order: []string{"c", "b", "a"},
+		},
+		{
+			name: "unrelated barclamps are sorted by name",
+			metadata: map[string]*CrowbarYML{
+				"zebra": requiring("zebra"),
+				"apple": requiring("apple"),
+				"mango": requiring("mango", "zebra"),
+			},
+			order: []string{"apple", "zebra", "mango"},
+		},
+		{
+			name: "everything depends on crowbar",
+			metadata: map[string]*CrowbarYML{
+				"a":       requiring("a"),
+				"crowbar": requiring("crowbar"),
+			},
+			order: []string{"crowbar", "a"},
+		},
+		{
+			name: "cycle",
+			metadata: map[string]*CrowbarYML{
+				"a": requiring("a", "b"),
+				"b": requiring("b", "c"),
+				"c": requiring("c", "a"),
+			},
+			cycle: []string{"a", "b", "c", "a"},
+		},
+		{
+			name: "cycle behind a dependent",
+			metadata: map[string]*CrowbarYML{
+				"a": requiring("a", "b"),
+				"b": requiring("b", "c"),
+				"c": requiring("c", "d"),
+				"d": requiring("d", "b"),
+			},
+			cycle: []string{"b", "c", "d", "b"},
+		},
+		{
+			name: "missing requirement",
+			metadata: map[string]*CrowbarYML{
+				"a": requiring("a", "b"),
+				"b": requiring("b", "nope"),
+			},
+			missing: &MissingDependencyError{Barclamp: "b", Requires: "nope"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order, err := Toposort(test.metadata)
+			switch {
+			case test.cycle != nil:
+				cycleErr, ok := err.(*CycleError)
+				if !ok {
+					t.Fatalf("Expected a *CycleError, got %v", err)
+				}
+				if !reflect.DeepEqual(cycleErr.Path, test.cycle) {
+					t.Errorf("Expected cycle %v, got %v", test.cycle, cycleErr.Path)
+				}
+			case test.missing != nil:
+				missingErr, ok := err.(*MissingDependencyError)
+				if !ok {
+					t.Fatalf("Expected a *MissingDependencyError, got %v", err)
+				}
+				if *missingErr != *test.missing {
+					t.Errorf("Expected %v, got %v", test.missing, missingErr)
+				}
+			case err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case !reflect.DeepEqual(order, test.order):
+				t.Errorf("Expected order %v, got %v", test.order, order)
+			}
+		})
+	}
+}
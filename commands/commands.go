@@ -1,22 +1,36 @@
 package commands
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	dev "github.com/VictorLowther/crowbar-devtool/devtool"
 	buildutils "github.com/VictorLowther/crowbar-devtool/build"
 	"github.com/VictorLowther/go-git/git"
 	c "github.com/gonuts/commander"
 	"github.com/gonuts/flag"
+	"launchpad.net/goyaml"
 	"path/filepath"
 	"log"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var baseCommand *c.Commander
 
+// The Crowbar checkout we are operating on.
+var ws *dev.Workspace
+
+// Global settings from the command line that get passed on to ws.
+var (
+	jobs    int
+	timeout time.Duration
+)
+
 func addCommand(parent *c.Commander, cmd *c.Command) {
 	if parent == nil {
 		parent = baseCommand
@@ -36,28 +50,114 @@ func addSubCommand(parent *c.Commander, subcmd *c.Commander) *c.Commander {
 	return subcmd
 }
 
+// If e is not nil, log it as a fatal error and die.
+// Otherwise, don't do anything.
+func dieIfError(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+// Find Crowbar, or die trying.
+func mustFindCrowbar() {
+	if ws != nil {
+		return
+	}
+	var err error
+	ws, err = dev.Open("")
+	dieIfError(err)
+	ws.Jobs, ws.Timeout = jobs, timeout
+}
+
+// Get the current release, or die trying.
+func mustCurrentRelease() dev.Release {
+	res, err := ws.CurrentRelease()
+	dieIfError(err)
+	return res
+}
+
+// Get the current build, or die trying.
+func mustCurrentBuild() dev.Build {
+	res, err := ws.CurrentBuild()
+	dieIfError(err)
+	return res
+}
+
+// Get a release by name, or die trying.
+func mustGetRelease(name string) dev.Release {
+	res, err := ws.GetRelease(name)
+	dieIfError(err)
+	return res
+}
+
 func showCrowbar(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	log.Printf("Crowbar is located at: %s\n", dev.Repo.Path())
+	mustFindCrowbar()
+	if jsonOutput() {
+		emitJSON(map[string]string{"path": ws.Repo.Path()})
+		return
+	}
+	log.Printf("Crowbar is located at: %s\n", ws.Repo.Path())
 }
 
 func fetch(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	ok, _ := dev.Fetch(nil)
+	mustFindCrowbar()
+	ok, res, err := ws.Fetch(nil)
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
 	if !ok {
 		os.Exit(1)
 	}
 	log.Printf("All updates fetched.\n")
 }
 
-func sync(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	ok, _ := dev.IsClean()
+// Whether dev push should only show what it would push.
+var pushDryRun bool
+
+func push(cmd *c.Command, args []string) {
+	if len(args) > 1 {
+		log.Fatalf("push takes at most one remote!")
+	}
+	mustFindCrowbar()
+	remote := ""
+	if len(args) == 1 {
+		remote = args[0]
+	}
+	ok, res, err := ws.Push(mustCurrentRelease(), remote, pushDryRun)
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
 	if !ok {
+		os.Exit(1)
+	}
+	switch {
+	case len(res) == 0:
+		log.Println("Nothing to push.")
+	case pushDryRun:
+		log.Printf("%d branches have changes to push.\n", len(res))
+	default:
+		log.Println("All local changes pushed.")
+	}
+}
+
+func sync(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	ok, res, err := ws.Rebase()
+	finishRebase(cmd, args, ok, res, err, "rebasing local changes")
+}
+
+// Report how a rebase (possibly after a fetch) went, and exit.
+func finishRebase(cmd *c.Command, args []string, ok bool, res dev.ResultTokens, err error, what string) {
+	if errors.Is(err, dev.ErrDirtyRepo) {
 		log.Printf("Cannot rebase local changes, Crowbar is not clean.\n")
 		isClean(cmd, args)
 	}
-	ok, res := dev.Rebase()
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
 	if ok {
 		log.Println("All local changes rebased against upstream.")
 		os.Exit(0)
@@ -65,19 +165,31 @@ func sync(cmd *c.Command, args []string) {
 	for _, tok := range res {
 		log.Printf("%v: %v %v\n", tok.Name, tok.OK, tok.Results)
 	}
-	log.Println("Errors rebasing local changes.  All changes unwound.")
+	log.Printf("Errors %s.  All changes unwound.\n", what)
 	os.Exit(1)
 }
 
 func isClean(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	ok, items := dev.IsClean()
+	mustFindCrowbar()
+	ok, items, err := ws.IsClean()
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: items})
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if ok {
 		log.Println("All Crowbar repositories are clean.")
 		os.Exit(0)
 	}
 	for _, item := range items {
 		if !item.OK {
+			if err, isErr := item.Results.(error); isErr {
+				log.Printf("Could not check %s: %v\n", item.Name, err)
+				continue
+			}
 			log.Printf("%s is not clean:\n", item.Name)
 			for _, line := range item.Results.(git.StatLines) {
 				log.Printf("\t%s\n", line.Print())
@@ -89,69 +201,108 @@ func isClean(cmd *c.Command, args []string) {
 }
 
 func currentRelease(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	fmt.Println(dev.CurrentRelease().Name())
+	mustFindCrowbar()
+	if jsonOutput() {
+		emitJSON(makeReleaseDoc(mustCurrentRelease()))
+		return
+	}
+	fmt.Println(mustCurrentRelease().Name())
 }
 
 func showBuild(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	fmt.Println(dev.CurrentBuild().FullName())
+	mustFindCrowbar()
+	if jsonOutput() {
+		build := mustCurrentBuild()
+		emitJSON(makeBuildDoc(build, dev.BarclampsInBuild(build)))
+		return
+	}
+	fmt.Println(mustCurrentBuild().FullName())
 }
 
 func releases(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	res := make([]string, 0, 20)
-	for release := range dev.Releases() {
+	for release := range ws.Releases() {
 		res = append(res, release)
 	}
 	sort.Strings(res)
+	if jsonOutput() {
+		emitJSON(res)
+		return
+	}
 	for _, release := range res {
 		fmt.Println(release)
 	}
 }
 
 func builds(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	res := make([]string, 0, 20)
 	if len(args) == 0 {
-		for build := range dev.CurrentRelease().Builds() {
-			res = append(res, dev.CurrentRelease().Name()+"/"+build)
+		for build := range mustCurrentRelease().Builds() {
+			res = append(res, mustCurrentRelease().Name()+"/"+build)
 		}
 	} else {
 		for _, release := range args {
-			for build := range dev.GetRelease(release).Builds() {
+			for build := range mustGetRelease(release).Builds() {
 				res = append(res, release+"/"+build)
 			}
 		}
 	}
 	sort.Strings(res)
+	if jsonOutput() {
+		emitJSON(res)
+		return
+	}
 	for _, build := range res {
 		fmt.Println(build)
 	}
 }
 
+// Show changes found by one of the change-finding functions.
+func showChanges(sets []*dev.ChangeSet) {
+	if jsonOutput() {
+		emitJSON(sets)
+		return
+	}
+	dev.ShowChanges(sets)
+}
+
 func localChanges(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	switch len(args) {
-	case 0: dev.LocalChanges(dev.CurrentRelease())
-	case 1: dev.LocalChanges(dev.GetRelease(args[0]))
-	default: log.Fatalf("%s takes 0 or 1 release name!\n",cmd.Name())
+	case 0:
+		showChanges(dev.LocalChanges(mustCurrentRelease()))
+	case 1:
+		showChanges(dev.LocalChanges(mustGetRelease(args[0])))
+	default:
+		log.Fatalf("%s takes 0 or 1 release name!\n", cmd.Name())
 	}
 }
 
 func remoteChanges(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	switch len(args) {
-	case 0: dev.RemoteChanges(dev.CurrentRelease())
-	case 1: dev.RemoteChanges(dev.GetRelease(args[0]))
-	default: log.Fatalf("%s takes 0 or 1 release name!\n",cmd.Name())
+	case 0:
+		showChanges(dev.RemoteChanges(mustCurrentRelease()))
+	case 1:
+		showChanges(dev.RemoteChanges(mustGetRelease(args[0])))
+	default:
+		log.Fatalf("%s takes 0 or 1 release name!\n", cmd.Name())
 	}
 }
 
 func crossReleaseChanges (cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
+	releases := mustReleasePair(cmd, args)
+	showChanges(dev.CrossReleaseChanges(releases[0], releases[1]))
+}
+
+// Translate a target and base release from the command line.
+// Either can be "current", and the base can be "parent".
+func mustReleasePair(cmd *c.Command, args []string) *[2]dev.Release {
 	if len(args) != 2 {
-		log.Fatalf("%s takes exactly 2 release names!")
+		log.Fatalf("%s takes exactly 2 release names!", cmd.Name())
 	}
 	releases := new([2]dev.Release)
 	// Translate command line parameters.
@@ -159,7 +310,7 @@ func crossReleaseChanges (cmd *c.Command, args []string) {
 	// releases[1] will be the base release.
 	for i,name := range args {
 		switch name {
-		case "current": releases[i] = dev.CurrentRelease()
+		case "current": releases[i] = mustCurrentRelease()
 		case "parent":
 			if i == 0 {
 				log.Fatalf("parent can only be the second arg to %s\n",cmd.Name())
@@ -168,27 +319,264 @@ func crossReleaseChanges (cmd *c.Command, args []string) {
 			if releases[1] == nil {
 				log.Fatalf("%s does not have a parent release.\n",releases[0].Name())
 			}
-		default: releases[i] = dev.GetRelease(name)
+		default: releases[i] = mustGetRelease(name)
 		}
 	}
-	dev.CrossReleaseChanges(releases[0],releases[1])
+	return releases
+}
+
+func checkVersions(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	releases := mustReleasePair(cmd, args)
+	checks := dev.CheckVersions(releases[0], releases[1])
+	bad := 0
+	for _, check := range checks {
+		if check.Problem != "" {
+			bad++
+		}
+	}
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{"ok": bad == 0, "barclamps": checks})
+	} else {
+		for _, check := range checks {
+			status := "ok"
+			if check.Problem != "" {
+				status = check.Problem
+			}
+			fmt.Printf("%s: %d -> %d: %s\n", check.Barclamp, check.BaseVersion, check.TargetVersion, status)
+		}
+	}
+	if bad > 0 {
+		log.Fatalf("%d barclamps have version problems in %s compared to %s.", bad, releases[0].Name(), releases[1].Name())
+	}
+}
+
+// Whether dev release merge-up should merge into every child release.
+var mergeChildren bool
+
+func mergeUp(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2) == mergeChildren {
+		log.Fatalf("merge-up takes a release to merge from, and either a release to merge into or --children")
+	}
+	from := mustCurrentRelease()
+	if args[0] != "current" {
+		from = mustGetRelease(args[0])
+	}
+	to := make([]dev.Release, 0, 1)
+	if mergeChildren {
+		names := make([]string, 0)
+		releases := ws.Releases()
+		for name, rel := range releases {
+			if parent := rel.Parent(); parent != nil && parent.Name() == from.Name() {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			to = append(to, releases[name])
+		}
+		if len(to) == 0 {
+			log.Fatalf("Release %s does not have any children.", from.Name())
+		}
+	} else if args[1] == "current" {
+		to = append(to, mustCurrentRelease())
+	} else {
+		to = append(to, mustGetRelease(args[1]))
+	}
+	ok, res, err := ws.MergeUp(from, to)
+	if errors.Is(err, dev.ErrDirtyRepo) {
+		log.Printf("Cannot merge releases, Crowbar is not clean.\n")
+		isClean(cmd, args)
+	}
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
+	if ok {
+		for _, tok := range res {
+			log.Printf("%s: %v\n", tok.Name, tok.Results)
+		}
+		log.Printf("Merged %s into %d releases.\n", from.Name(), len(to))
+		return
+	}
+	for _, tok := range res {
+		if !tok.OK {
+			log.Printf("%s: %v\n", tok.Name, tok.Results)
+		}
+	}
+	log.Println("Errors merging releases.  All merges unwound.")
+	os.Exit(1)
+}
+
+// Flags for dev release backport.
+var (
+	backportBarclamp string
+	backportGrep     string
+	backportYes      bool
+)
+
+// Ask which commits to backport.  Answering a picks the rest of
+// the commits, and q skips the rest.
+func chooseCommits(commits []*dev.Commit) []*dev.Commit {
+	res := make([]*dev.Commit, 0, len(commits))
+	in := bufio.NewReader(os.Stdin)
+	for i, commit := range commits {
+		fmt.Fprintf(os.Stderr, "Backport %s? [y,n,a,q] ", commit)
+		answer, err := in.ReadString('\n')
+		if err != nil && answer == "" {
+			log.Fatalf("No answer, not backporting anything.")
+		}
+		switch strings.TrimSpace(answer) {
+		case "y", "Y":
+			res = append(res, commit)
+		case "a", "A":
+			return append(res, commits[i:]...)
+		case "q", "Q":
+			return res
+		}
+	}
+	return res
+}
+
+func backport(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	releases := mustReleasePair(cmd, args)
+	var grep *regexp.Regexp
+	if backportGrep != "" {
+		var err error
+		grep, err = regexp.Compile(backportGrep)
+		dieIfError(err)
+	}
+	commits, err := dev.BackportCandidates(releases[0], releases[1], backportBarclamp, grep)
+	dieIfError(err)
+	if len(commits) == 0 {
+		log.Printf("Nothing in %s needs to be backported to %s.\n", releases[0].Name(), releases[1].Name())
+		return
+	}
+	if !backportYes {
+		commits = chooseCommits(commits)
+		if len(commits) == 0 {
+			log.Println("Nothing picked, not backporting anything.")
+			return
+		}
+	}
+	ok, res, err := ws.Backport(releases[1], commits)
+	if errors.Is(err, dev.ErrDirtyRepo) {
+		log.Printf("Cannot backport changes, Crowbar is not clean.\n")
+		isClean(cmd, args)
+	}
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
+	if ok {
+		log.Printf("Backported %d commits from %s to %s.\n", len(commits), releases[0].Name(), releases[1].Name())
+		return
+	}
+	for _, tok := range res {
+		if !tok.OK {
+			log.Printf("%s: %v\n", tok.Name, tok.Results)
+		}
+	}
+	log.Println("Errors backporting changes.  All changes unwound.")
+	os.Exit(1)
+}
+
+func tagRelease(cmd *c.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("release tag takes a release and a tag name.")
+	}
+	mustFindCrowbar()
+	rel := mustCurrentRelease()
+	if args[0] != "current" {
+		rel = mustGetRelease(args[0])
+	}
+	ok, res, err := ws.TagRelease(rel, args[1])
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
+	if !ok {
+		for _, tok := range res {
+			if !tok.OK {
+				log.Printf("%s: %v\n", tok.Name, tok.Results)
+			}
+		}
+		log.Fatalf("Failed to tag %s as %s.  All tags removed.", rel.Name(), args[1])
+	}
+	log.Printf("Tagged %d repositories in %s as %s.\n", len(res), rel.Name(), args[1])
+}
+
+// Whether dev release lock should check the lock instead of making it.
+var lockCheck bool
+
+func lockRelease(cmd *c.Command, args []string) {
+	if len(args) > 1 {
+		log.Fatalf("release lock takes at most one release.")
+	}
+	mustFindCrowbar()
+	rel := mustCurrentRelease()
+	if len(args) == 1 && args[0] != "current" {
+		rel = mustGetRelease(args[0])
+	}
+	if !lockCheck {
+		lock, err := ws.LockRelease(rel)
+		dieIfError(err)
+		if jsonOutput() {
+			emitJSON(map[string]interface{}{"release": rel.Name(), "lock": lock})
+			return
+		}
+		log.Printf("Locked %d barclamps in %s.\n", len(lock), rel.Name())
+		return
+	}
+	drifts, err := dev.CheckLock(rel)
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{"release": rel.Name(), "ok": len(drifts) == 0, "drift": drifts})
+	} else {
+		for _, drift := range drifts {
+			switch {
+			case drift.Branch == "":
+				fmt.Printf("%s: locked at %s, but no longer in %s\n", drift.Barclamp, drift.Locked, rel.Name())
+			case drift.Locked == "":
+				fmt.Printf("%s: %s is not locked\n", drift.Barclamp, drift.Branch)
+			case drift.Current == "":
+				fmt.Printf("%s: locked at %s, but %s cannot be found\n", drift.Barclamp, drift.Locked, drift.Branch)
+			default:
+				fmt.Printf("%s: locked at %s, but %s is at %s\n", drift.Barclamp, drift.Locked, drift.Branch, drift.Current)
+			}
+		}
+	}
+	if len(drifts) > 0 {
+		log.Fatalf("%d barclamps in %s have drifted from the lock.", len(drifts), rel.Name())
+	}
+	log.Printf("%s matches its lock.\n", rel.Name())
 }
 
 func barclampsInBuild(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	if len(args) > 1 {
+		log.Fatalf("barclamps-in-build takes at most one build.")
+	}
+	mustFindCrowbar()
 	res := make([]string, 0, 20)
 	var build dev.Build
 	var found bool
 	if len(args) == 0 {
-		build = dev.CurrentBuild()
-	} else if len(args) == 1 {
-		builds := dev.Builds()
+		build = mustCurrentBuild()
+	} else {
+		builds := ws.Builds()
 		build, found = builds[args[0]]
 		if !found {
-			log.Fatalln("No such build %s", args[0])
+			log.Fatalf("No such build %s", args[0])
 		}
 	}
-	for name := range dev.BarclampsInBuild(build) {
+	barclamps := dev.BarclampsInBuild(build)
+	if jsonOutput() {
+		emitJSON(makeBuildDoc(build, barclamps))
+		return
+	}
+	for name := range barclamps {
 		res = append(res, name)
 	}
 	sort.Strings(res)
@@ -198,44 +586,112 @@ func barclampsInBuild(cmd *c.Command, args []string) {
 }
 
 func cloneBarclamps(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	dev.CloneBarclamps()
+	mustFindCrowbar()
+	dieIfError(ws.CloneBarclamps())
+}
+
+// Flags for dev switch.
+var (
+	switchTag    string
+	switchLocked bool
+)
+
+func switchToTag(cmd *c.Command, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("switch --tag does not take a build or release.")
+	}
+	ok, tokens, err := ws.SwitchTag(switchTag)
+	if errors.Is(err, dev.ErrMissingBarclamps) {
+		log.Println(err)
+		log.Fatalln("Please try running dev clone-barclamps to resolve this error.")
+	}
+	if errors.Is(err, dev.ErrDirtyRepo) {
+		log.Fatalln("Crowbar is not clean, cannot switch to a tag.")
+	}
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{
+			"tag":     switchTag,
+			"ok":      ok,
+			"results": tokens,
+		})
+	}
+	for _, tok := range tokens {
+		if tok.Results != nil && !jsonOutput() {
+			log.Printf("%s: %v\n", tok.Name, tok.Results)
+		}
+	}
+	if !ok {
+		log.Fatalf("Failed to switch to tag %s!  All changes unwound.\n", switchTag)
+	}
+	log.Printf("Switched to tag %s.  Use dev switch to get back to a build.\n", switchTag)
 }
 
 func switchBuild(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	if ok, _ := dev.IsClean(); !ok {
-		log.Fatalln("Crowbar is not clean, cannot switch builds.")
+	mustFindCrowbar()
+	if switchTag != "" {
+		if switchLocked {
+			log.Fatalf("switch takes either --tag or --locked, not both.")
+		}
+		switchToTag(cmd, args)
+		return
 	}
-	rels := dev.Releases()
-	current := dev.CurrentBuild()
+	rels := ws.Releases()
+	// We may not have a current build yet, so current can be nil.
+	current, _ := ws.CurrentBuild()
 	var target dev.Build
 	found := false
 	switch len(args) {
 	case 0:
-		target, found = current, true
+		target, found = current, current != nil
 	case 1:
 		// Were we passed a known release?
 		rel, foundRel := rels[args[0]]
 		if foundRel {
-			for _, build := range []string{current.Name(), "master"} {
+			candidates := []string{"master"}
+			if current != nil {
+				candidates = []string{current.Name(), "master"}
+			}
+			for _, build := range candidates {
 				target, found = rel.Builds()[build]
 				if found {
 					break
 				}
 			}
 		} else {
-			target, found = dev.Builds()[args[0]]
+			target, found = ws.Builds()[args[0]]
 		}
 	default:
 		log.Fatalf("switch takes 0 or 1 argument.")
 	}
 	if !found {
-		log.Fatalf("%s is not anything we can switch to!")
+		log.Fatalf("%s is not anything we can switch to!", strings.Join(args, " "))
+	}
+	var ok bool
+	var tokens dev.ResultTokens
+	var err error
+	if switchLocked {
+		ok, tokens, err = ws.SwitchLocked(target)
+	} else {
+		ok, tokens, err = ws.Switch(target)
+	}
+	if errors.Is(err, dev.ErrMissingBarclamps) {
+		log.Println(err)
+		log.Fatalln("Please try running dev clone-barclamps to resolve this error.")
+	}
+	if errors.Is(err, dev.ErrDirtyRepo) {
+		log.Fatalln("Crowbar is not clean, cannot switch builds.")
+	}
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{
+			"build":   target.FullName(),
+			"ok":      ok,
+			"results": tokens,
+		})
 	}
-	ok, tokens := dev.Switch(target)
 	for _, tok := range tokens {
-		if tok.Results != nil {
+		if tok.Results != nil && !jsonOutput() {
 			log.Printf("%s: %v\n", tok.Name, tok.Results)
 		}
 	}
@@ -244,13 +700,16 @@ func switchBuild(cmd *c.Command, args []string) {
 		os.Exit(0)
 	}
 	log.Printf("Failed to switch to %s!\n", target.FullName())
-	ok, _ = dev.Switch(current)
+	if current != nil {
+		ws.Switch(current)
+	}
 	os.Exit(1)
 }
 
 func update(cmd *c.Command, args []string) {
-	fetch(cmd, args)
-	sync(cmd, args)
+	mustFindCrowbar()
+	ok, res, err := ws.Update()
+	finishRebase(cmd, args, ok, res, err, "fetching or rebasing local changes")
 }
 
 func addRemote(cmd *c.Command, args []string) {
@@ -277,12 +736,12 @@ func addRemote(cmd *c.Command, args []string) {
 	default:
 		log.Fatalf("Adding a remote takes at least 1 and most 3 parameters!")
 	}
-	dev.ValidateRemote(remote)
-	dev.MustFindCrowbar()
-	if dev.Remotes[remote.Name] != nil {
+	dieIfError(dev.ValidateRemote(remote))
+	mustFindCrowbar()
+	if ws.Remotes[remote.Name] != nil {
 		log.Fatalf("%s is already a Crowbar remote.", remote.Name)
 	}
-	dev.AddRemote(remote)
+	dieIfError(ws.AddRemote(remote))
 	os.Exit(0)
 }
 
@@ -290,12 +749,12 @@ func zapRemote(cmd *c.Command, args []string) {
 	if len(args) != 1 {
 		log.Fatalf("remote rm only accepts one argument!\n")
 	}
-	dev.MustFindCrowbar()
-	remote, found := dev.Remotes[args[0]]
+	mustFindCrowbar()
+	remote, found := ws.Remotes[args[0]]
 	if !found {
 		log.Fatalf("%s is not a remote!\n", args[0])
 	}
-	dev.ZapRemote(remote)
+	dieIfError(ws.ZapRemote(remote))
 }
 
 func zapBuild(cmd *c.Command, args []string) {
@@ -303,13 +762,13 @@ func zapBuild(cmd *c.Command, args []string) {
 		log.Fatalf("remove-build only accepts one argument!\n")
 	}
 	buildName := args[0]
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	if !strings.Contains(buildName, "/") {
 		// We were passed what appears to be a raw build name.
 		// Turn it into a real build by prepending the release name.
-		buildName = dev.CurrentRelease().Name() + "/" + buildName
+		buildName = mustCurrentRelease().Name() + "/" + buildName
 	}
-	builds := dev.Builds()
+	builds := ws.Builds()
 	build, found := builds[buildName]
 	if !found {
 		log.Fatalf("%s is not a build, cannot delete it!", buildName)
@@ -327,9 +786,9 @@ func removeRelease(cmd *c.Command, args []string) {
 	if len(args) != 1 {
 		log.Fatalf("remove-release only accepts one argument!")
 	}
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	releaseName := args[0]
-	releases := dev.Releases()
+	releases := ws.Releases()
 	release, found := releases[releaseName]
 	if !found {
 		log.Fatalf("%s is not a release!\n", releaseName)
@@ -337,7 +796,7 @@ func removeRelease(cmd *c.Command, args []string) {
 	if releaseName == "development" {
 		log.Fatal("Cannot delete the development release.")
 	}
-	if err := dev.RemoveRelease(release); err != nil {
+	if err := ws.RemoveRelease(release); err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("Release %s deleted.\n", releaseName)
@@ -347,22 +806,34 @@ func splitRelease(cmd *c.Command, args []string) {
 	if len(args) != 1 {
 		log.Fatalf("split-release only accepts one argument!")
 	}
-	dev.MustFindCrowbar()
-	current := dev.CurrentRelease()
-	if _, err := dev.SplitRelease(current, args[0]); err != nil {
+	mustFindCrowbar()
+	current := mustCurrentRelease()
+	if _, err := ws.SplitRelease(current, args[0]); err != nil {
 		log.Println(err)
 		log.Fatalf("Could not split new release %s from %s", args[0], current.Name())
 	}
 }
 
 func showRelease(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
+	rels := make([]dev.Release, 0, 1)
 	if len(args) == 0 {
-		dev.ShowRelease(dev.CurrentRelease())
+		rels = append(rels, mustCurrentRelease())
 	} else {
 		for _, rel := range args {
-			dev.ShowRelease(dev.GetRelease(rel))
+			rels = append(rels, mustGetRelease(rel))
+		}
+	}
+	if jsonOutput() {
+		docs := make([]*releaseDoc, 0, len(rels))
+		for _, rel := range rels {
+			docs = append(docs, makeReleaseDoc(rel))
 		}
+		emitJSON(docs)
+		return
+	}
+	for _, rel := range rels {
+		dev.ShowRelease(rel)
 	}
 }
 
@@ -370,20 +841,24 @@ func renameRemote(cmd *c.Command, args []string) {
 	if len(args) != 2 {
 		log.Fatalf("remote rename takes exactly 2 arguments.\n")
 	}
-	dev.MustFindCrowbar()
-	remote, found := dev.Remotes[args[0]]
+	mustFindCrowbar()
+	remote, found := ws.Remotes[args[0]]
 	if !found {
 		log.Fatalf("%s is not a Crowbar remote.", args[0])
 	}
-	if _, found = dev.Remotes[args[1]]; found {
+	if _, found = ws.Remotes[args[1]]; found {
 		log.Fatalf("%s is already a remote, cannot rename %s to it\n", args[1], args[0])
 	}
-	dev.RenameRemote(remote, args[1])
+	dieIfError(ws.RenameRemote(remote, args[1]))
 }
 
 func updateTracking(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	ok, res := dev.UpdateTrackingBranches()
+	mustFindCrowbar()
+	ok, res, err := ws.UpdateTrackingBranches()
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(&resultDoc{OK: ok, Results: res})
+	}
 	if ok {
 		os.Exit(0)
 	}
@@ -397,50 +872,486 @@ func updateTracking(cmd *c.Command, args []string) {
 }
 
 func listRemotes(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	for _, remote := range dev.SortedRemotes() {
+	mustFindCrowbar()
+	if jsonOutput() {
+		emitJSON(ws.SortedRemotes())
+		os.Exit(0)
+	}
+	for _, remote := range ws.SortedRemotes() {
 		fmt.Printf("%s: urlbase=%s, priority=%d\n", remote.Name, remote.Urlbase, remote.Priority)
 	}
 	os.Exit(0)
 }
 
 func showRemote(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	if len(args) != 1 {
 		log.Fatal("Need exactly 1 argument.")
 	}
-	remote, found := dev.Remotes[args[0]]
+	remote, found := ws.Remotes[args[0]]
 	if !found {
 		log.Fatalf("%s is not a remote!\n", args[0])
 	}
+	if jsonOutput() {
+		emitJSON(remote)
+		os.Exit(0)
+	}
 	fmt.Printf("Remote %s:\n\tUrlbase: %s\n\tPriority: %d\n", remote.Name, remote.Urlbase, remote.Priority)
 	os.Exit(0)
 }
 
 func syncRemotes(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
-	dev.SyncRemotes()
+	mustFindCrowbar()
+	ws.SyncRemotes()
 }
 
 func setRemoteURLBase(cmd *c.Command, args []string) {
-	dev.MustFindCrowbar()
+	mustFindCrowbar()
 	if len(args) != 2 {
 		log.Fatal("Need exactly 2 arguments")
 	}
-	remote, found := dev.Remotes[args[0]]
+	remote, found := ws.Remotes[args[0]]
 	if !found {
 		log.Fatalf("%s is not a remote!\n", args[0])
 	}
-	dev.SetRemoteURLBase(remote, args[1])
+	dieIfError(ws.SetRemoteURLBase(remote, args[1]))
+}
+
+// The format dev build graph should use.
+var graphFormat string
+
+func graphBuild(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, _ := mustBuildArgs(args, 0)
+	srcs, problems := buildSources(build)
+	for _, problem := range problems {
+		log.Println(problem)
+	}
+	missing := make([]string, 0)
+	for name, bc := range dev.BarclampsInBuild(build) {
+		if bc.Repo == nil {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	graph, err := buildutils.LoadGraph(srcs, missing)
+	dieIfError(err)
+	switch graphFormat {
+	case "dot":
+		fmt.Print(graph.DOT(build.FullName()))
+	case "json":
+		emitJSON(graph)
+	default:
+		log.Fatalf("Unknown graph format %s, must be dot or json", graphFormat)
+	}
+}
+
+// The OS dev build packages should make a manifest for.
+var packagesOS string
+
+func buildPackages(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, _ := mustBuildArgs(args, 0)
+	if packagesOS == "" {
+		log.Fatalf("build packages needs --os")
+	}
+	manifest, err := mustBuildMetadata(build).PackageManifest(packagesOS)
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(manifest)
+		return
+	}
+	buf, err := goyaml.Marshal(manifest)
+	dieIfError(err)
+	os.Stdout.Write(buf)
+}
+
+func buildOSMatrix(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, _ := mustBuildArgs(args, 0)
+	srcs, problems := buildSources(build)
+	for _, problem := range problems {
+		log.Printf("%v, leaving it out.\n", problem)
+	}
+	matrix, err := buildutils.OSSupportMatrix(srcs)
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(matrix)
+		return
+	}
+	fmt.Print(matrix)
+}
+
+// Whether dev build-sane should check every build.
+var saneAll bool
+
+// The results of sanity checking one build.
+type saneDoc struct {
+	Build         string                     `json:"build"`
+	OK            bool                       `json:"ok"`
+	Problems      buildutils.Problems        `json:"problems,omitempty"`
+	Order         []string                   `json:"order,omitempty"`
+	Substitutions []*buildutils.Substitution `json:"substitutions,omitempty"`
+}
+
+// Read the crowbar.yml for every barclamp in a build straight from the
+// branch the build uses.  Barclamps that are not cloned or that do not
+// have a crowbar.yml are returned as problems.
+func buildSources(build dev.Build) ([]*buildutils.Source, buildutils.Problems) {
+	barclamps := dev.BarclampsInBuild(build)
+	names := make([]string, 0, len(barclamps))
+	for name := range barclamps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	srcs := make([]*buildutils.Source, 0, len(names))
+	problems := make(buildutils.Problems, 0)
+	for _, name := range names {
+		bc := barclamps[name]
+		path := fmt.Sprintf("barclamps/%s/crowbar.yml@%s", bc.Name, bc.Branch)
+		data, err := bc.ReadFile("crowbar.yml")
+		if err != nil {
+			problems = append(problems, &buildutils.Problem{Path: path, Message: err.Error()})
+			continue
+		}
+		srcs = append(srcs, &buildutils.Source{Path: path, Data: data, Exists: bc.HasFile})
+	}
+	return srcs, problems
+}
+
+// Lint and sanity check a single build.
+func checkBuild(build dev.Build) *saneDoc {
+	res := &saneDoc{Build: build.FullName()}
+	srcs, problems := buildSources(build)
+	res.Problems = append(problems, buildutils.LintSources(srcs)...)
+	sort.Stable(res.Problems)
+	if len(res.Problems) > 0 {
+		return res
+	}
+	meta, err := buildutils.LoadSources(srcs)
+	if err != nil {
+		res.Problems = append(res.Problems, &buildutils.Problem{Path: build.FullName(), Message: err.Error()})
+		return res
+	}
+	res.OK, res.Order, res.Substitutions = true, meta.Order, meta.Substitutions
+	return res
+}
+
+func sanityCheckBuild(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	builds := make([]dev.Build, 0, len(args))
+	switch {
+	case saneAll && len(args) > 0:
+		log.Fatalf("build-sane takes either --all or a list of builds, not both.")
+	case saneAll:
+		all := ws.Builds()
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			builds = append(builds, all[name])
+		}
+	case len(args) == 0:
+		builds = append(builds, mustCurrentBuild())
+	default:
+		for _, name := range args {
+			build, err := ws.GetBuild(name)
+			dieIfError(err)
+			builds = append(builds, build)
+		}
+	}
+	docs := make([]*saneDoc, 0, len(builds))
+	failed := 0
+	for _, build := range builds {
+		doc := checkBuild(build)
+		docs = append(docs, doc)
+		if !doc.OK {
+			failed++
+		}
+		if jsonOutput() {
+			continue
+		}
+		fmt.Printf("%s:\n", doc.Build)
+		for _, problem := range doc.Problems {
+			fmt.Printf("\t%s\n", problem)
+		}
+		for _, sub := range doc.Substitutions {
+			fmt.Printf("\t%s\n", sub)
+		}
+		if doc.OK {
+			fmt.Printf("\tInstall order: %s\n", strings.Join(doc.Order, " "))
+		}
+	}
+	if jsonOutput() {
+		emitJSON(docs)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d builds failed sanity checks.", failed, len(builds))
+	}
+}
+
+// The cache directory for dev build check-extras and fetch-extras.
+var extrasCache string
+
+// Work out which cache directory to use.  It defaults to $CACHE_DIR,
+// or ~/.crowbar-build-cache like the build system uses.
+func mustExtrasCache() string {
+	switch {
+	case extrasCache != "":
+		return extrasCache
+	case os.Getenv("CACHE_DIR") != "":
+		return os.Getenv("CACHE_DIR")
+	case os.Getenv("HOME") != "":
+		return filepath.Join(os.Getenv("HOME"), ".crowbar-build-cache")
+	}
+	log.Fatalf("Cannot figure out where the build cache is, please pass --cache")
+	return ""
+}
+
+// Load the metadata for a build from the crowbar.yml files on the
+// branches the build uses.
+func mustBuildMetadata(build dev.Build) *buildutils.MetadataSet {
+	srcs, problems := buildSources(build)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		log.Fatalf("Cannot read the metadata for %s.", build.FullName())
+	}
+	meta, err := buildutils.LoadSources(srcs)
+	dieIfError(err)
+	return meta
+}
+
+// Find the extras for a build from the crowbar.yml files on the
+// branches the build uses.
+func mustBuildExtras(build dev.Build) []*buildutils.Extra {
+	extras, err := mustBuildMetadata(build).Extras(mustExtrasCache())
+	dieIfError(err)
+	return extras
+}
+
+// Print extras grouped by barclamp.
+func showExtras(extras []*buildutils.Extra) {
+	last := ""
+	for _, extra := range extras {
+		if extra.Barclamp != last {
+			fmt.Printf("%s:\n", extra.Barclamp)
+			last = extra.Barclamp
+		}
+		switch {
+		case extra.Cached:
+			fmt.Printf("\tcached: %s\n", extra)
+		case len(extra.MissingBranches) > 0:
+			fmt.Printf("\tmissing branches %s: %s\n", strings.Join(extra.MissingBranches, ", "), extra)
+		default:
+			fmt.Printf("\tmissing: %s\n", extra)
+		}
+	}
+}
+
+func checkExtras(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, _ := mustBuildArgs(args, 0)
+	extras := mustBuildExtras(build)
+	missing := 0
+	for _, extra := range extras {
+		extra.Check()
+		if !extra.Cached {
+			missing++
+		}
+	}
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{"ok": missing == 0, "extras": extras})
+	} else {
+		showExtras(extras)
+	}
+	if missing > 0 {
+		log.Fatalf("%d of %d extras for %s are not cached.", missing, len(extras), build.FullName())
+	}
+}
+
+func fetchExtras(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, _ := mustBuildArgs(args, 0)
+	extras := mustBuildExtras(build)
+	failed := ws.FetchExtras(extras)
+	if jsonOutput() {
+		emitJSON(map[string]interface{}{"ok": failed == 0, "extras": extras})
+	} else {
+		showExtras(extras)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to fetch %d of %d extras for %s.", failed, len(extras), build.FullName())
+	}
+}
+
+func recoverCrowbar(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	if err := ws.Recover(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func sanityCheckBuild(cmd *c.Command,args []string) {
-	dev.MustFindCrowbar()
-	paths := make([]string,0,0)
-	for _,bc := range dev.BarclampsInBuild(dev.CurrentBuild()){
-		paths = append(paths,filepath.Join(bc.Repo.Path(),"crowbar.yml"))
+// Whether dev rollback-last should roll back even if branches have
+// changed since the last operation.
+var rollbackForce bool
+
+func rollbackLast(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	if err := ws.RollbackLast(rollbackForce); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Last operation rolled back.")
+}
+
+// barclampFlags collects repeated --barclamp name[=branch] flags.
+type barclampFlags dev.BarclampMap
+
+func (f barclampFlags) String() string {
+	res := make([]string, 0, len(f))
+	for name, bc := range f {
+		if bc.Branch == "" {
+			res = append(res, name)
+		} else {
+			res = append(res, name+"="+bc.Branch)
+		}
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+func (f barclampFlags) Set(val string) error {
+	bc, err := parseBarclampArg(val)
+	if err != nil {
+		return err
+	}
+	f[bc.Name] = bc
+	return nil
+}
+
+// Turn name or name=branch into a Barclamp.
+func parseBarclampArg(val string) (*dev.Barclamp, error) {
+	parts := strings.SplitN(val, "=", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("Barclamp name cannot be empty")
+	}
+	bc := &dev.Barclamp{Name: parts[0]}
+	if len(parts) == 2 {
+		bc.Branch = parts[1]
+	}
+	return bc, nil
+}
+
+// Flags for dev build new.
+var (
+	buildParent    string
+	buildBarclamps = make(barclampFlags)
+)
+
+// Split a possibly fully qualified build name into a release and a build name.
+// If there is no release part, the current release is used.
+func mustSplitBuildName(name string) (dev.Release, string) {
+	idx := strings.LastIndex(name, "/")
+	if idx == -1 {
+		return mustCurrentRelease(), name
+	}
+	return mustGetRelease(name[:idx]), name[idx+1:]
+}
+
+func newBuild(cmd *c.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("build new takes exactly one argument!")
+	}
+	mustFindCrowbar()
+	rel, name := mustSplitBuildName(args[0])
+	var parent dev.Build
+	parentName := buildParent
+	if parentName == "" && name != "master" {
+		parentName = "master"
+	}
+	if parentName != "" {
+		if strings.Contains(parentName, "/") {
+			var err error
+			parent, err = ws.GetBuild(parentName)
+			dieIfError(err)
+		} else if parent = rel.Builds()[parentName]; parent == nil {
+			log.Fatalf("%s is not a build in %s", parentName, rel.Name())
+		}
+	}
+	build, err := ws.NewBuild(rel, name, parent, dev.BarclampMap(buildBarclamps))
+	dieIfError(err)
+	if jsonOutput() {
+		emitJSON(makeBuildDoc(build, dev.BarclampsInBuild(build)))
+		return
+	}
+	log.Printf("Build %s created.\n", build.FullName())
+}
+
+// Get the build named by the first of args if there are want+1 of them,
+// or the current build if there are want of them.  Returns the build and
+// the rest of the args.
+func mustBuildArgs(args []string, want int) (dev.Build, []string) {
+	switch len(args) {
+	case want:
+		return mustCurrentBuild(), args
+	case want + 1:
+		build, err := ws.GetBuild(args[0])
+		dieIfError(err)
+		return build, args[1:]
+	}
+	log.Fatalf("Expected %d or %d arguments, got %d", want, want+1, len(args))
+	return nil, nil
+}
+
+func addBuildBarclamp(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, args := mustBuildArgs(args, 1)
+	bc, err := parseBarclampArg(args[0])
+	dieIfError(err)
+	dieIfError(ws.AddBuildBarclamp(build, bc))
+	log.Printf("Added %s on %s to %s.\n", bc.Name, bc.Branch, build.FullName())
+}
+
+func rmBuildBarclamp(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, args := mustBuildArgs(args, 1)
+	dieIfError(ws.RemoveBuildBarclamp(build, args[0]))
+	log.Printf("Removed %s from %s.\n", args[0], build.FullName())
+}
+
+func setBuildBranch(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	build, args := mustBuildArgs(args, 2)
+	dieIfError(ws.SetBuildBarclampBranch(build, args[0], args[1]))
+	log.Printf("%s in %s now uses %s.\n", args[0], build.FullName(), args[1])
+}
+
+// The metadata backend that dev metadata convert should convert to.
+var metadataTarget string
+
+func showMetadata(cmd *c.Command, args []string) {
+	mustFindCrowbar()
+	if jsonOutput() {
+		emitJSON(map[string]string{"backend": ws.MetadataBackend()})
+		return
+	}
+	fmt.Printf("Release metadata is stored as %s\n", ws.MetadataBackend())
+}
+
+func convertMetadata(cmd *c.Command, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("metadata convert does not take any arguments!")
+	}
+	if metadataTarget == "" {
+		log.Fatalf("metadata convert needs --to ref, --to yaml, or --to flat")
 	}
-	buildutils.SanityCheckMetadata(paths)
+	mustFindCrowbar()
+	from := ws.MetadataBackend()
+	dieIfError(ws.ConvertMetadata(metadataTarget))
+	log.Printf("Release metadata converted from %s to %s.\n", from, metadataTarget)
 }
 
 func init() {
@@ -448,6 +1359,12 @@ func init() {
 		Name: "dev",
 		Flag: flag.NewFlagSet("dev", flag.ExitOnError),
 	}
+	baseCommand.Flag.IntVar(&jobs, "jobs", 0,
+		"Maximum number of repositories to operate on at once.  Defaults to crowbar.jobs, or the number of CPUs.")
+	baseCommand.Flag.DurationVar(&timeout, "timeout", 0,
+		"How long an operation may run in any one repository before it is cancelled.  Defaults to crowbar.timeout, or forever.")
+	baseCommand.Flag.StringVar(&outputFormat, "output", "text",
+		"Output format for commands that report information.  Can be text or json.")
 	// Core Crowbar commands.
 	addCommand(nil, &c.Command{
 		Run:       isClean,
@@ -488,16 +1405,39 @@ and exits with an exit code of 1.`,
 		UsageLine: "fetch",
 		Short:     "Fetches updates from all remotes",
 	})
+	pushCmd := &c.Command{
+		Run:       push,
+		UsageLine: "push [remote] --dry-run",
+		Short:     "Push local changes in the current release to a remote.",
+		Long: `Push every branch that a build in the current release uses that has
+local commits that are not on the remote, along with the branch checked out
+in the main Crowbar repository.  The remote defaults to the highest priority
+one.  Branches the remote does not have yet are pushed and set up to track the
+branch they create, and the release metadata ref is pushed along with them if
+it has changed.  With --dry-run, show what would be pushed without pushing
+anything.`,
+	}
+	pushCmd.Flag.BoolVar(&pushDryRun, "dry-run", false, "Show what would be pushed without pushing it.")
+	addCommand(nil, pushCmd)
 	addCommand(nil, &c.Command{
 		Run:       sync,
 		UsageLine: "sync",
 		Short:     "Rebase local changes on their tracked upstream changes.",
 	})
-	addCommand(nil, &c.Command{
+	switchCmd := &c.Command{
 		Run:       switchBuild,
-		UsageLine: "switch [build or release]",
+		UsageLine: "switch [build or release] --tag [tag] --locked",
 		Short:     "Switch to the named release or build",
-	})
+		Long: `Switch the barclamps to the branches for the named build, or for the
+current build in the named release (or its master build).  With --locked,
+check out the commits recorded by dev release lock instead of the tips of the
+branches.  With --tag, check out exactly the commits that were tagged by dev
+release tag, including the one in the main Crowbar repository.  Both leave
+the repositories they check out on detached HEADs.`,
+	}
+	switchCmd.Flag.StringVar(&switchTag, "tag", "", "Check out the commits recorded for this release tag.")
+	switchCmd.Flag.BoolVar(&switchLocked, "locked", false, "Check out the commits in the release lock.")
+	addCommand(nil, switchCmd)
 	addCommand(nil, &c.Command{
 		Run:       update,
 		UsageLine: "update",
@@ -523,11 +1463,39 @@ and exits with an exit code of 1.`,
 		UsageLine: "clone-barclamps",
 		Short:     "Attempts to clone any missing barclamps.",
 	})
-	addCommand(nil, &c.Command{
+	buildSane := &c.Command{
 		Run:       sanityCheckBuild,
-		UsageLine: "build-sane",
-		Short:     "Sanity-check the build metadata for the current build.",
+		UsageLine: "build-sane [build...|--all]",
+		Short:     "Sanity-check the build metadata for the current, passed, or all builds.",
+		Long: `Check the crowbar.yml files of every barclamp in a build, and make sure
+their dependencies can be resolved.  The crowbar.yml files are read straight
+from the branches each build uses, so nothing needs to be checked out.  All
+the problems found in all the builds are reported before exiting.`,
+	}
+	buildSane.Flag.BoolVar(&saneAll, "all", false, "Check every build in every release.")
+	addCommand(nil, buildSane)
+	addCommand(nil, &c.Command{
+		Run:       recoverCrowbar,
+		UsageLine: "recover",
+		Short:     "Undo the changes made by an interrupted journaled operation.",
+		Long: `Undo the changes made by a journaled operation that was interrupted
+before it could finish.  The journaled operations are fetch, update, sync,
+switch (including --tag and --locked), retrack, release merge-up, and
+release backport.`,
 	})
+	rollbackCmd := &c.Command{
+		Run:       rollbackLast,
+		UsageLine: "rollback-last --force",
+		Short:     "Undo the changes made by the last journaled operation.",
+		Long: `Undo the changes made by the last journaled operation.  The journaled
+operations are fetch, update, sync, switch (including --tag and --locked),
+retrack, release merge-up, and release backport.  If any branch has changed
+since then, any repository has uncommitted changes, or the state a repository
+was left in could not be recorded, rolling back would throw those changes
+away, so this refuses to unless --force is given.`,
+	}
+	rollbackCmd.Flag.BoolVar(&rollbackForce, "force", false, "Roll back even if repositories have changed since the last operation.")
+	addCommand(nil, rollbackCmd)
 
 	// Release Handling commands
 	release := addSubCommand(nil, &c.Commander{
@@ -564,6 +1532,168 @@ and exits with an exit code of 1.`,
 		UsageLine: "changes [target] [base]",
 		Short: "Show commits that are in the target release that are not in the base release.",
 	})
+	addCommand(release, &c.Command{
+		Run:       checkVersions,
+		UsageLine: "check-versions [target] [base]",
+		Short:     "Check that barclamps with changes in the target release have higher versions than in the base release.",
+	})
+	releaseMergeUp := &c.Command{
+		Run:       mergeUp,
+		UsageLine: "merge-up [from] [to] --children",
+		Short:     "Merge a release into another release, or into all of its child releases.",
+		Long: `Merge the branch of every barclamp in the from release into the branch
+the to release (or, with --children, each child release of from) uses for it,
+for every barclamp that has changes that have not been merged yet.  All the
+repositories must be clean.  If any merge conflicts, all the merges are
+rolled back.`,
+	}
+	releaseMergeUp.Flag.BoolVar(&mergeChildren, "children", false, "Merge into every release whose parent is the from release.")
+	addCommand(release, releaseMergeUp)
+	addCommand(release, &c.Command{
+		Run:       tagRelease,
+		UsageLine: "tag [release] [tag]",
+		Short:     "Tag every barclamp in a release and the main Crowbar repository.",
+		Long: `Tag the tip of the branch every barclamp in the release uses, and record
+what was tagged in the release metadata so that dev switch --tag can check it
+out later.  The main Crowbar repository is tagged after the tag is recorded,
+so the tagged commit includes the record.  The main Crowbar repository must be
+clean.  If any repository cannot be tagged, the tags are removed from all of
+them and the record is taken back out.`,
+	})
+	releaseLock := &c.Command{
+		Run:       lockRelease,
+		UsageLine: "lock [release] --check",
+		Short:     "Lock the barclamps in a release to the commits their branches are at.",
+		Long: `Record the commit that the branch of every barclamp in the release
+points at in the release metadata, so that dev switch --locked can check out
+the same code later.  With --check, report every barclamp whose branch has
+moved since the release was locked instead, and exit with an exit code of 1
+if there are any.`,
+	}
+	releaseLock.Flag.BoolVar(&lockCheck, "check", false, "Report drift between the lock and the branch tips instead of locking.")
+	addCommand(release, releaseLock)
+	releaseBackport := &c.Command{
+		Run:       backport,
+		UsageLine: "backport [target] [base] --barclamp [name] --grep [pattern] --yes",
+		Short:     "Cherry-pick commits that are in the target release onto the base release.",
+		Long: `Cherry-pick commits that are in the target release but not in the base
+release onto the branches the base release uses.  --barclamp limits this to
+one barclamp, and --grep to commits whose subject matches a regular expression.
+You will be asked about each commit unless --yes is passed, in which case
+every matching commit is picked.  All the repositories must be clean.  If any
+pick fails, all the picks are rolled back.`,
+	}
+	releaseBackport.Flag.StringVar(&backportBarclamp, "barclamp", "", "Only backport commits in this barclamp.")
+	releaseBackport.Flag.StringVar(&backportGrep, "grep", "", "Only backport commits whose subject matches this regular expression.")
+	releaseBackport.Flag.BoolVar(&backportYes, "yes", false, "Backport every matching commit without asking.")
+	addCommand(release, releaseBackport)
+
+	// Build management commands.
+	build := addSubCommand(nil, &c.Commander{
+		Name:  "build",
+		Short: "Subcommands dealing with builds",
+	})
+	buildNew := &c.Command{
+		Run:       newBuild,
+		UsageLine: "new [name] --parent [build] --barclamp [name[=branch]]...",
+		Short:     "Create a new build in a release.",
+		Long: `Create a new build.  The name can be a full release/build name, or
+just a build name to create it in the current release.  The parent defaults
+to the master build in the release.  Each --barclamp adds a barclamp to the
+build, and if no branch is given it uses the branch the parent build uses,
+or the release branch if the parent does not have the barclamp.`,
+	}
+	buildNew.Flag.StringVar(&buildParent, "parent", "", "The parent of the new build.")
+	buildNew.Flag.Var(buildBarclamps, "barclamp", "A barclamp to add to the build, as name or name=branch.  Can be repeated.")
+	addCommand(build, buildNew)
+	buildGraph := &c.Command{
+		Run:       graphBuild,
+		UsageLine: "graph [build] --format [dot|json]",
+		Short:     "Show the barclamp dependency graph for the current or passed build.",
+		Long: `Show the dependency graph of the barclamps in a build, as declared by
+the requires, member, and supercedes directives in their crowbar.yml files.
+Groups are shown as their own nodes, and barclamps that are required but not
+in the build (or not cloned) are highlighted in red.`,
+	}
+	buildGraph.Flag.StringVar(&graphFormat, "format", "dot", "Output format, either dot or json.")
+	addCommand(build, buildGraph)
+	buildPkgs := &c.Command{
+		Run:       buildPackages,
+		UsageLine: "packages [build] --os [os]",
+		Short:     "Show the merged package manifest for the current or passed build.",
+		Long: `Merge the base and OS-specific repos, pkgs, and build_pkgs from the
+crowbar.yml files of every barclamp in a build, along with their gems, in
+dependency order.  Duplicates are dropped.  The manifest is printed as YAML,
+or as JSON with --output json.`,
+	}
+	buildPkgs.Flag.StringVar(&packagesOS, "os", "", "The OS to make the manifest for, such as ubuntu-12.04.")
+	addCommand(build, buildPkgs)
+	addCommand(build, &c.Command{
+		Run:       buildOSMatrix,
+		UsageLine: "os-matrix [build]",
+		Short:     "Show which operating systems the barclamps in the current or passed build support.",
+	})
+	buildCheckExtras := &c.Command{
+		Run:       checkExtras,
+		UsageLine: "check-extras [build] --cache [dir]",
+		Short:     "Check that the extra files and git repos the current or passed build needs are cached.",
+		Long: `Check the local build cache for the files in extra_files and the
+repositories and branches in git_repo of every barclamp in a build.  This does
+not need the network.  Missing extras are reported for each barclamp, and the
+command exits with an exit code of 1 if anything is missing.  The cache
+defaults to $CACHE_DIR, or ~/.crowbar-build-cache.`,
+	}
+	buildCheckExtras.Flag.StringVar(&extrasCache, "cache", "", "The build cache directory.")
+	addCommand(build, buildCheckExtras)
+	buildFetchExtras := &c.Command{
+		Run:       fetchExtras,
+		UsageLine: "fetch-extras [build] --cache [dir]",
+		Short:     "Fetch the extra files and git repos the current or passed build needs into the cache.",
+		Long: `Download the files in extra_files and mirror the repositories in
+git_repo of every barclamp in a build into the local build cache.  Files that
+are already cached are left alone, and cached repositories are updated.`,
+	}
+	buildFetchExtras.Flag.StringVar(&extrasCache, "cache", "", "The build cache directory.")
+	addCommand(build, buildFetchExtras)
+	addCommand(build, &c.Command{
+		Run:       addBuildBarclamp,
+		UsageLine: "add-barclamp [build] [barclamp[=branch]]",
+		Short:     "Add a barclamp to the current or passed build.",
+	})
+	addCommand(build, &c.Command{
+		Run:       rmBuildBarclamp,
+		UsageLine: "rm-barclamp [build] [barclamp]",
+		Short:     "Remove a barclamp from the current or passed build.",
+	})
+	addCommand(build, &c.Command{
+		Run:       setBuildBranch,
+		UsageLine: "set-branch [build] [barclamp] [branch]",
+		Short:     "Change the branch a barclamp uses in the current or passed build.",
+	})
+
+	// Metadata management commands.
+	metadata := addSubCommand(nil, &c.Commander{
+		Name:  "metadata",
+		Short: "Subcommands dealing with how release metadata is stored",
+	})
+	addCommand(metadata, &c.Command{
+		Run:       showMetadata,
+		UsageLine: "show",
+		Short:     "Show which backend the release metadata is stored with.",
+	})
+	convert := &c.Command{
+		Run:       convertMetadata,
+		UsageLine: "convert --to [ref|yaml|flat]",
+		Short:     "Convert the release metadata to a different backend.",
+		Long: `Convert the release and build metadata to a different backend and
+commit the result in the main Crowbar repository.  The ref backend keeps
+everything in releases.yml on refs/crowbar/metadata, independent of the
+checked out branch.  The yaml backend keeps everything in releases.yml in
+the working tree, and the flat backend keeps everything in barclamp-* and
+parent files under releases/.`,
+	}
+	convert.Flag.StringVar(&metadataTarget, "to", "", "The backend to convert to, either ref, yaml, or flat.")
+	addCommand(metadata, convert)
 
 	// Remote Management commands.
 	remote := addSubCommand(nil, &c.Commander{
@@ -616,6 +1746,9 @@ and exits with an exit code of 1.`,
 // Run is the main entry point for actually running a dev command.
 func Run() {
 	err := baseCommand.Flag.Parse(os.Args[1:])
+	if err == nil {
+		err = validateOutputFormat()
+	}
 	if err != nil {
 		fmt.Printf("**err**: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	dev "github.com/VictorLowther/crowbar-devtool/devtool"
+	"log"
+	"os"
+	"sort"
+)
+
+// The output format that commands should use, as set by --output.
+// Either "text" or "json".
+var outputFormat string
+
+// Returns true if commands should emit JSON instead of text.
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// Make sure we were passed an output format we know how to produce.
+func validateOutputFormat() error {
+	switch outputFormat {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("Unknown output format %s, must be text or json", outputFormat)
+}
+
+// Write a document out to stdout as indented JSON.
+func emitJSON(doc interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// The JSON representation of a repoMapReduce based operation.
+type resultDoc struct {
+	OK      bool             `json:"ok"`
+	Results dev.ResultTokens `json:"results"`
+}
+
+// The JSON representation of a barclamp in a build.
+type barclampDoc struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	Path   string `json:"path,omitempty"`
+}
+
+// The JSON representation of a build.
+type buildDoc struct {
+	Name      string         `json:"name"`
+	Release   string         `json:"release"`
+	Parent    string         `json:"parent,omitempty"`
+	Barclamps []*barclampDoc `json:"barclamps"`
+}
+
+// The JSON representation of a release.
+type releaseDoc struct {
+	Name   string   `json:"name"`
+	Parent string   `json:"parent,omitempty"`
+	Branch string   `json:"branch,omitempty"`
+	Builds []string `json:"builds"`
+	Tags   []string `json:"tags"`
+}
+
+// Translate a BarclampMap into a slice of barclampDocs sorted by name.
+func makeBarclampDocs(barclamps dev.BarclampMap) []*barclampDoc {
+	names := make([]string, 0, len(barclamps))
+	for name := range barclamps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*barclampDoc, 0, len(names))
+	for _, name := range names {
+		bc := barclamps[name]
+		doc := &barclampDoc{Name: bc.Name, Branch: bc.Branch}
+		if bc.Repo != nil {
+			doc.Path = bc.Repo.Path()
+		}
+		res = append(res, doc)
+	}
+	return res
+}
+
+// Make the JSON representation of a build.
+// barclamps should be all the barclamps in the build, including
+// the ones inherited from its parents.
+func makeBuildDoc(build dev.Build, barclamps dev.BarclampMap) *buildDoc {
+	res := &buildDoc{
+		Name:      build.FullName(),
+		Release:   build.Release().Name(),
+		Barclamps: makeBarclampDocs(barclamps),
+	}
+	if parent := build.Parent(); parent != nil {
+		res.Parent = parent.FullName()
+	}
+	return res
+}
+
+// Make the JSON representation of a release.
+func makeReleaseDoc(rel dev.Release) *releaseDoc {
+	branch, _ := dev.ReleaseBranch(rel.Name())
+	res := &releaseDoc{
+		Name:   rel.Name(),
+		Branch: branch,
+		Builds: make([]string, 0, 4),
+		Tags:   make([]string, 0),
+	}
+	if parent := rel.Parent(); parent != nil {
+		res.Parent = parent.Name()
+	}
+	for name := range rel.Builds() {
+		res.Builds = append(res.Builds, name)
+	}
+	sort.Strings(res.Builds)
+	for name := range rel.Tags() {
+		res.Tags = append(res.Tags, name)
+	}
+	sort.Strings(res.Tags)
+	return res
+}
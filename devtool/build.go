@@ -0,0 +1,191 @@
+package devtool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Get a specific build.  name can either be a full build name
+// (release/build), or just the name of a build in the current release.
+func (w *Workspace) GetBuild(name string) (Build, error) {
+	if !strings.Contains(name, "/") {
+		rel, err := w.CurrentRelease()
+		if err != nil {
+			return nil, err
+		}
+		name = rel.Name() + "/" + name
+	}
+	res, found := w.Builds()[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchBuild, name)
+	}
+	return res, nil
+}
+
+// Make sure a build name can be used as a new build in rel.
+func validBuildName(rel Release, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: builds must have a name", ErrInvalidBuild)
+	case strings.ContainsAny(name, "/ \t\n"):
+		return fmt.Errorf("%w: %s cannot contain slashes or whitespace", ErrInvalidBuild, name)
+	case name == "parent" || name == "extra" || name == "change-image":
+		return fmt.Errorf("%w: %s is reserved", ErrInvalidBuild, name)
+	}
+	if _, found := rel.Builds()[name]; found {
+		return fmt.Errorf("%w: %s already exists", ErrInvalidBuild, rel.Name()+"/"+name)
+	}
+	return nil
+}
+
+// Make sure that a barclamp can be part of a build.
+// The barclamp must be cloned, and its branch must exist.
+func (w *Workspace) validBuildBarclamp(bc *Barclamp) error {
+	repo, found := w.Barclamps[bc.Name]
+	if !found {
+		return fmt.Errorf("%w: barclamp %s is not cloned", ErrMissingBarclamps, bc.Name)
+	}
+	if _, err := repo.Ref(bc.Branch); err != nil {
+		return fmt.Errorf("%w: barclamp %s does not have a branch named %s",
+			ErrInvalidBuild, bc.Name, bc.Branch)
+	}
+	bc.Repo = repo
+	return nil
+}
+
+// Figure out what branch a barclamp should use in a build if
+// we were not told.  If the parent build has the barclamp we use
+// its branch, otherwise we use the release branch.
+func defaultBarclampBranch(rel Release, parent Build, name string) (string, error) {
+	if bc, found := BarclampsInBuild(parent)[name]; found {
+		return bc.Branch, nil
+	}
+	return ReleaseBranch(rel.Name())
+}
+
+// NewBuild creates a new build named name in rel.
+// parent must be a build in rel, or nil if the new build should not have
+// a parent.  Any barclamps that do not have a branch get the branch the
+// parent build uses for them, or the release branch if the parent
+// does not have them.
+func (w *Workspace) NewBuild(rel Release, name string, parent Build, barclamps BarclampMap) (Build, error) {
+	if err := validBuildName(rel, name); err != nil {
+		return nil, err
+	}
+	if parent != nil && parent.Release().Name() != rel.Name() {
+		return nil, fmt.Errorf("%w: parent build %s is not in release %s",
+			ErrInvalidBuild, parent.FullName(), rel.Name())
+	}
+	if parent == nil && name != "master" {
+		return nil, fmt.Errorf("%w: only master builds can be created without a parent", ErrInvalidBuild)
+	}
+	for bcName, bc := range barclamps {
+		if bc.Name == "" {
+			bc.Name = bcName
+		}
+		if bc.Branch == "" {
+			branch, err := defaultBarclampBranch(rel, parent, bc.Name)
+			if err != nil {
+				return nil, err
+			}
+			bc.Branch = branch
+		}
+		if err := w.validBuildBarclamp(bc); err != nil {
+			return nil, err
+		}
+	}
+	return rel.AddBuild(name, parent, barclamps)
+}
+
+// All the builds in the same release that descend from build.
+func childBuilds(build Build) []Build {
+	res := make([]Build, 0)
+	for _, candidate := range build.Release().Builds() {
+		for p := candidate.Parent(); p != nil; p = p.Parent() {
+			if p.Name() == build.Name() {
+				res = append(res, candidate)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// AddBuildBarclamp adds a barclamp to a build.  If bc does not have a
+// branch, it gets one the same way NewBuild picks them.  The barclamp
+// must not already be in the build or any of its children.
+func (w *Workspace) AddBuildBarclamp(build Build, bc *Barclamp) error {
+	if _, found := build.Barclamps()[bc.Name]; found {
+		return fmt.Errorf("%w: %s is already in %s", ErrInvalidBuild, bc.Name, build.FullName())
+	}
+	for _, child := range childBuilds(build) {
+		if _, found := child.Barclamps()[bc.Name]; found {
+			return fmt.Errorf("%w: child build %s already provides %s",
+				ErrInvalidBuild, child.FullName(), bc.Name)
+		}
+	}
+	if bc.Branch == "" {
+		branch, err := defaultBarclampBranch(build.Release(), build.Parent(), bc.Name)
+		if err != nil {
+			return err
+		}
+		bc.Branch = branch
+	}
+	if err := w.validBuildBarclamp(bc); err != nil {
+		return err
+	}
+	return build.SetBarclamp(bc)
+}
+
+// RemoveBuildBarclamp removes a barclamp from a build.  The barclamp
+// must be part of the build itself, not inherited from its parent.
+func (w *Workspace) RemoveBuildBarclamp(build Build, name string) error {
+	if _, found := build.Barclamps()[name]; !found {
+		if _, inherited := BarclampsInBuild(build)[name]; inherited {
+			return fmt.Errorf("%w: %s is inherited by %s, remove it from the parent build instead",
+				ErrInvalidBuild, name, build.FullName())
+		}
+		return fmt.Errorf("%w: %s is not in %s", ErrInvalidBuild, name, build.FullName())
+	}
+	return build.RemoveBarclamp(name)
+}
+
+// SetBuildBarclampBranch changes the branch a build uses for a barclamp.
+// The barclamp must be part of the build itself, and the branch must exist.
+func (w *Workspace) SetBuildBarclampBranch(build Build, name, branch string) error {
+	old, found := build.Barclamps()[name]
+	if !found {
+		return fmt.Errorf("%w: %s is not in %s", ErrInvalidBuild, name, build.FullName())
+	}
+	if old.Branch == branch {
+		return fmt.Errorf("%w: %s already uses %s in %s", ErrInvalidBuild, name, branch, build.FullName())
+	}
+	bc := &Barclamp{Name: name, Branch: branch}
+	if err := w.validBuildBarclamp(bc); err != nil {
+		return err
+	}
+	return build.SetBarclamp(bc)
+}
+
+// ReadFile reads a file from the branch of the barclamp that the build
+// uses, without checking anything out.
+func (bc *Barclamp) ReadFile(name string) ([]byte, error) {
+	if bc.Repo == nil {
+		return nil, fmt.Errorf("%w: barclamp %s is not cloned", ErrMissingBarclamps, bc.Name)
+	}
+	cmd, out, _ := bc.Repo.Git("cat-file", "blob", bc.Branch+":"+name)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s does not exist on branch %s of %s", name, bc.Branch, bc.Name)
+	}
+	return out.Bytes(), nil
+}
+
+// HasFile reports whether a file exists on the branch of the barclamp
+// that the build uses.
+func (bc *Barclamp) HasFile(name string) bool {
+	if bc.Repo == nil {
+		return false
+	}
+	cmd, _, _ := bc.Repo.Git("cat-file", "-e", bc.Branch+":"+name)
+	return cmd.Run() == nil
+}
@@ -2,15 +2,19 @@ package devtool
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/VictorLowther/go-git/git"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Barclamp is the type that is at the leaf node of the release tracking
@@ -54,10 +58,15 @@ type Build interface {
 	Parent() Build
 	// Perform whatver metadata-specific tasks are needed to
 	// finaize a switch operation.
-	FinalizeSwitch()
+	FinalizeSwitch() error
 	// Remove a build.  The build must not be named "master", and the
 	// build must not have any children.
 	Zap() error
+	// Add a barclamp to this build, or change the branch it uses, and
+	// save the change.  The caller is responsible for validation.
+	SetBarclamp(bc *Barclamp) error
+	// Remove a barclamp from this build and save the change.
+	RemoveBarclamp(name string) error
 }
 
 // BuildMap maps build names to types that satisfy the Build interface.
@@ -81,6 +90,20 @@ type Release interface {
 	Barclamps() BarclampMap
 	// Metadata operations for finalizing a split of a release
 	FinalizeSplit(string, string) (Release, error)
+	// Create a new build in this release with the passed name, parent,
+	// and barclamps, and save it.  The caller is responsible for making
+	// sure the name, parent, and barclamps make sense.
+	AddBuild(name string, parent Build, barclamps BarclampMap) (Build, error)
+	// The tags that have been made of this release, along with the
+	// commit each repository was at when it was tagged.
+	Tags() map[string]Snapshot
+	// Record a new tag of this release and save it.
+	AddTag(name string, snap Snapshot) error
+	// The commit each barclamp branch in this release was locked to,
+	// or nil if the release has not been locked.
+	Lock() Snapshot
+	// Replace the lock for this release and save it.
+	SetLock(snap Snapshot) error
 }
 
 // ReleaseMap maps release names to releases.
@@ -100,11 +123,14 @@ type Metadata interface {
 // Remote tracks the common parts of git remotes across the various
 // Crowbar repositories, and provides a mechanism for sorting them.
 type Remote struct {
-	Priority      int
-	Urlbase, Name string
+	Priority int    `json:"priority"`
+	Urlbase  string `json:"urlbase"`
+	Name     string `json:"name"`
 }
 
-var (
+// Workspace is a single Crowbar checkout, along with everything
+// we know about it.  Use Open to get one.
+type Workspace struct {
 	// Repo points at the top-level Crowbar git repository.
 	Repo *git.Repo
 	// Barclamps tracks all the barclamps that this crowbar checkout
@@ -116,45 +142,57 @@ var (
 	// Meta holds a reference to the metadata for this Crowbar checkout.
 	// This may turn into a slice in the future.
 	Meta Metadata
-)
-
-// If e is of type error, log it as a fatal error and die.
-// Otherwise, don't do anything.
-func dieIfError(e error) {
-	if e != nil {
-		log.Fatal(e)
-	}
+	// Jobs is the maximum number of mappers that repoMapReduce will
+	// run at once.  If it is less than 1, the crowbar.jobs git config
+	// setting in the main Crowbar repository is consulted, and if that is
+	// not set we fall back to the number of CPUs on the machine.
+	Jobs int
+	// Timeout is how long a single mapper in repoMapReduce is allowed to
+	// run before it is cancelled.  If it is not positive, the crowbar.timeout
+	// git config setting is consulted, and if that is not set mappers are
+	// allowed to run forever.
+	Timeout time.Duration
+	// The journal of the operation that is running, if any.
+	journal *journal
 }
 
-// Find Crowbar from the current path.
-func findCrowbar(path string) (err error) {
+// Open finds the Crowbar checkout that path is in, and loads
+// everything we know about it.  If path is empty, the current directory
+// is used.
+func Open(path string) (w *Workspace, err error) {
 	if path == "" {
-		path, err = os.Getwd()
-		dieIfError(err)
+		if path, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, err
 	}
-	path, err = filepath.Abs(path)
-	dieIfError(err)
 	repo, err := git.Open(path)
 	if err != nil {
-		return errors.New("Cannot find Crowbar")
+		return nil, ErrNoCrowbar
 	}
 	path = repo.Path()
 	parent := filepath.Dir(path)
 	// If this is a raw repo, recurse and keep looking.
 	if repo.IsRaw() {
-		return findCrowbar(parent)
+		return Open(parent)
 	}
 	// See if we have something that looks like a crowbar repo here.
 	stat, err := os.Stat(filepath.Join(path, "barclamps"))
 	if err != nil || !stat.IsDir() {
-		return findCrowbar(parent)
+		return Open(parent)
 	}
 	// We do.  Start populating our stuff.
-	Repo = repo
-	Barclamps = make(map[string]*git.Repo)
-	Remotes = make(map[string]*Remote)
+	w = &Workspace{
+		Repo:      repo,
+		Barclamps: make(RepoMap),
+		Remotes:   make(map[string]*Remote),
+	}
 	dirs, err := ioutil.ReadDir(filepath.Join(path, "barclamps"))
-	dieIfError(err)
+	if err != nil {
+		return nil, err
+	}
 	// populate our list of barclamps
 	for _, bc := range dirs {
 		if !bc.IsDir() {
@@ -174,21 +212,21 @@ func findCrowbar(path string) (err error) {
 			log.Println(err)
 			continue
 		}
-		Barclamps[bc.Name()] = repo
+		w.Barclamps[bc.Name()] = repo
 	}
 	// populate remotes next
 
-	remotes := Repo.Find("crowbar.remote.")
+	remotes := w.Repo.Find("crowbar.remote.")
 	var rem *Remote
 	for k, v := range remotes {
 		parts := strings.Split(k, ".")
-		if Remotes[parts[2]] == nil {
+		if w.Remotes[parts[2]] == nil {
 			rem = new(Remote)
 			rem.Name = parts[2]
 			rem.Priority = 50 // default.
-			Remotes[parts[2]] = rem
+			w.Remotes[parts[2]] = rem
 		} else {
-			rem = Remotes[parts[2]]
+			rem = w.Remotes[parts[2]]
 		}
 		switch parts[3] {
 		case "priority":
@@ -200,32 +238,22 @@ func findCrowbar(path string) (err error) {
 			rem.Urlbase = v
 		}
 	}
-	meta := new(FlatMetadata)
-	err = meta.Probe()
-	if err != nil {
-		return err
-	}
-	Meta = meta
-	return nil
-}
-
-// This is the same as findCrowbar, except we die if we cannot find Crowbar.
-func MustFindCrowbar() {
-	if Meta == nil {
-		dieIfError(findCrowbar(""))
+	if err = w.probeMetadata(); err != nil {
+		return nil, err
 	}
+	return w, nil
 }
 
 // Given a path, chop off the prefix if it matches the path to our working dir.
-func RelPath(path string) string {
+func (w *Workspace) RelPath(path string) string {
 	return strings.TrimPrefix(filepath.Clean(path),
-		filepath.Clean(Repo.WorkDir)+"/")
+		filepath.Clean(w.Repo.WorkDir)+"/")
 }
 
 // Get all of the builds we know how to build.
-func Builds() BuildMap {
+func (w *Workspace) Builds() BuildMap {
 	res := make(BuildMap)
-	for _, rel := range Releases() {
+	for _, rel := range w.Releases() {
 		for _, bld := range rel.Builds() {
 			res[bld.FullName()] = bld
 		}
@@ -234,9 +262,9 @@ func Builds() BuildMap {
 }
 
 // Get all the release branches we care about, sorted by barclamp.
-func AllBarclampBranches() (res map[string][]string) {
+func (w *Workspace) AllBarclampBranches() (res map[string][]string) {
 	res = make(map[string][]string)
-	for _, build := range Builds() {
+	for _, build := range w.Builds() {
 		for _, bc := range build.Barclamps() {
 			if res[bc.Name] == nil {
 				res[bc.Name] = make([]string, 0, 4)
@@ -249,48 +277,82 @@ func AllBarclampBranches() (res map[string][]string) {
 
 // Get all the barclamp repos, return them in a map whose keys are in the
 // of "barclamp-" + the barclamp name.
-func AllBarclampRepos() (res RepoMap) {
+func (w *Workspace) AllBarclampRepos() (res RepoMap) {
 	res = make(RepoMap)
-	for name, bc := range Barclamps {
+	for name, bc := range w.Barclamps {
 		res["barclamp-"+name] = bc
 	}
 	return res
 }
 
-func AllOtherRepos() (res RepoMap) {
+func (w *Workspace) AllOtherRepos() (res RepoMap) {
 	res = make(RepoMap)
-	res["crowbar"] = Repo
+	res["crowbar"] = w.Repo
 	return res
 }
 
 // Get all of the repositories that make up Crowbar.
-func AllRepos() (res RepoMap) {
-	res = AllBarclampRepos()
-	for k, v := range AllOtherRepos() {
+func (w *Workspace) AllRepos() (res RepoMap) {
+	res = w.AllBarclampRepos()
+	for k, v := range w.AllOtherRepos() {
 		res[k] = v
 	}
 	return res
 }
 
 // Perform a git fetch across all the repositories.
-func Fetch(remotes []string) (ok bool, results ResultTokens) {
-	repos := AllRepos()
+// The main Crowbar repository also fetches the shared release metadata
+// on refs/crowbar/metadata from the highest priority remote that has it.
+// Our copy is only fast-forwarded, never overwritten, and the metadata is
+// reloaded afterwards.
+func (w *Workspace) Fetch(remotes []string) (ok bool, results ResultTokens, err error) {
+	repos := w.AllRepos()
 	// mapper and reducer are the functions we will
 	// hand over to repoMapReduce.
 	// mapper is pretty simple, and doesn't really demonstrate
 	// anything useful.
-	mapper := func(name string, repo *git.Repo, res resultChan) {
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
 		tok := makeResultToken()
-		ok, items := repo.Fetch(remotes)
+		targets := remotes
+		if len(targets) == 0 {
+			for remote := range repo.Remotes() {
+				targets = append(targets, remote)
+			}
+		}
+		// Run the fetches ourselves so that a hung fetch can be killed
+		// when the operation times out or is interrupted.
+		ok, items := true, make(git.FetchMap)
+		for _, remote := range targets {
+			cmd, _, _ := repo.Git("fetch", remote)
+			items[remote] = runCmd(ctx, cmd) == nil
+			ok = ok && items[remote]
+		}
+		if repo == w.Repo {
+			if remote := metadataRemote(w.SortedRemotes(), targets); remote != "" {
+				key := remote + " " + metadataRef
+				err := fetchMetadataRef(ctx, repo, remote)
+				if errors.Is(err, ErrMetadataDiverged) {
+					// The fetch itself worked, so just
+					// let the user know.
+					log.Printf("%s: %v\n", name, err)
+					err = nil
+				}
+				items[key] = err == nil
+				ok = ok && items[key]
+			}
+		}
 		// Since you cannot unwind a fetch, use the default commit/rollback functions.
 		tok.Name, tok.OK, tok.Results = name, ok, items
+		if err := ctx.Err(); err != nil {
+			tok.Results = err
+		}
 		res <- tok
 	}
 	// reducer iterates over all the results as they arrive,
 	// printing status messages along the way and keeping
 	// a running idea about which fetches worked.
 	// It also serves to show off variable capture.
-	reducer := func(vals resultChan) (bool, ResultTokens) {
+	reducer := func(ctx context.Context, vals resultChan) (bool, ResultTokens) {
 		ok := true
 		res := make(ResultTokens, len(repos), len(repos))
 		for i := range res {
@@ -298,12 +360,11 @@ func Fetch(remotes []string) (ok bool, results ResultTokens) {
 			res[i] = item
 			if item.OK {
 				log.Printf("Fetched all updates for %s\n", item.Name)
+			} else if err, isErr := item.Results.(error); isErr {
+				log.Printf("Failed to fetch changes for %s: %v\n", item.Name, err)
 			} else {
 				log.Printf("Failed to fetch all changes for %s:\n", item.Name)
-				fetchResults, castOK := item.Results.(git.FetchMap)
-				if !castOK {
-					log.Panicf("Could not cast fetch results for %s into git.FetchMap\n", item.Name)
-				}
+				fetchResults, _ := item.Results.(git.FetchMap)
 				for k, v := range fetchResults {
 					if !v {
 						log.Printf("\tRemote %s failed\n", k)
@@ -315,56 +376,241 @@ func Fetch(remotes []string) (ok bool, results ResultTokens) {
 		return ok, res
 	}
 	// Now that all the setup is done, do it!
-	ok, results = repoMapReduce(repos, mapper, reducer)
-	// We do not care about the results of updating tracking branches here.
-	UpdateTrackingBranches()
+	// Fetching and updating the tracking branches are journaled as a
+	// single operation, and we report the results of the fetches.
+	// If retracking fails everything is rolled back, so the fetch as
+	// a whole failed too.
+	ok, _, err = w.journaled("fetch", w.Barclamps, func() (bool, ResultTokens, error) {
+		var fetched bool
+		if fetched, results, err = w.repoMapReduce(repos, mapper, reducer); err != nil {
+			return false, nil, err
+		}
+		retracked, res, err := w.UpdateTrackingBranches()
+		return fetched && retracked, res, err
+	})
+	if err == nil && ok {
+		err = w.probeMetadata()
+	}
 	return
 }
 
+// Pick the highest priority remote out of the ones being fetched from.
+func metadataRemote(remotes RemoteSlice, targets []string) string {
+	for _, remote := range remotes {
+		for _, target := range targets {
+			if remote.Name == target {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// pushItem is what Push will push from one repository.
+type pushItem struct {
+	// The repository being pushed from, for the log.
+	repo    string
+	refspec string
+	// What is being pushed, for the log.
+	what string
+	// The changes being pushed, if this is a branch.
+	set *ChangeSet
+	// Whether to make the branch track what we push it to.
+	setUpstream bool
+}
+
+// Make a pushItem for the changes on a branch.  Branches the remote
+// does not have yet are pushed whole, and set up to track the branch
+// they create.
+func newPushItem(set *ChangeSet) *pushItem {
+	item := &pushItem{
+		repo:    set.Repo,
+		refspec: set.Working + ":" + set.Working,
+		what:    fmt.Sprintf("%d commits on %s", len(set.Changes), set.Working),
+		set:     set,
+	}
+	if set.Base == "" {
+		item.what = fmt.Sprintf("new branch %s with %d commits", set.Working, len(set.Changes))
+		item.setUpstream = true
+	}
+	return item
+}
+
+// Push the local commits on the branches of a release that are not on
+// remote yet.  If remote is empty, the highest priority remote is used.
+// Every branch that any build of the release uses is considered, along
+// with the branch checked out in the main Crowbar repository, which is
+// where the flat and yaml metadata backends commit changes to the release
+// metadata.  Only branches with unpushed changes are pushed, and the
+// Results of each ResultToken is the ChangeSet that was (or would be)
+// pushed.  ResultTokens are named after the repository and the branch,
+// as in barclamp-foo:master.
+// Branches the remote does not have yet are pushed with -u, and their
+// ChangeSets have an empty Base.
+// The release metadata ref is pushed from the main Crowbar repository
+// along with them, with its name as the Results.
+// If dryRun is true, nothing is actually pushed.
+// Pushes cannot be unwound, so a failed push does not affect the others.
+func (w *Workspace) Push(rel Release, remote string, dryRun bool) (ok bool, results ResultTokens, err error) {
+	if remote == "" {
+		remotes := w.SortedRemotes()
+		if len(remotes) == 0 {
+			return false, nil, fmt.Errorf("%w: no remotes to push to", ErrNoSuchRemote)
+		}
+		remote = remotes[0].Name
+	} else if _, found := w.Remotes[remote]; !found {
+		return false, nil, fmt.Errorf("%w: %s", ErrNoSuchRemote, remote)
+	}
+	items := make(map[string]*pushItem)
+	repos := make(RepoMap)
+	for _, bc := range releaseBranches(rel) {
+		if set := unpushedChanges("barclamp-"+bc.Name, bc.Repo, bc.Branch, remote); set != nil {
+			key := set.Repo + ":" + set.Working
+			items[key], repos[key] = newPushItem(set), bc.Repo
+		}
+	}
+	if ref, err := w.Repo.CurrentRef(); err == nil {
+		if set := unpushedChanges("crowbar", w.Repo, ref.Name(), remote); set != nil {
+			key := set.Repo + ":" + set.Working
+			items[key], repos[key] = newPushItem(set), w.Repo
+		}
+	}
+	// The release metadata travels with the main Crowbar repository.
+	if w.Repo.HasRemote(remote) && metadataNeedsPush(w.Repo, remote) {
+		key := "crowbar:" + metadataRef
+		items[key] = &pushItem{
+			repo:    "crowbar",
+			refspec: metadataRef + ":" + metadataRef,
+			what:    "release metadata",
+		}
+		repos[key] = w.Repo
+	}
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
+		tok := makeResultToken()
+		item := items[name]
+		tok.Name, tok.OK = name, true
+		if item.set != nil {
+			tok.Results = item.set
+		} else {
+			tok.Results = metadataRef
+		}
+		if !dryRun {
+			args := []string{remote, item.refspec}
+			if item.setUpstream {
+				args = append([]string{"-u"}, args...)
+			}
+			cmd, _, stderr := repo.Git("push", args...)
+			if err := runCmd(ctx, cmd); err != nil {
+				tok.OK, tok.Results = false, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+			}
+		}
+		res <- tok
+	}
+	reducer := func(ctx context.Context, vals resultChan) (bool, ResultTokens) {
+		ok := true
+		res := make(ResultTokens, len(repos), len(repos))
+		for i := range res {
+			tok := <-vals
+			res[i] = tok
+			item := items[tok.Name]
+			switch {
+			case !tok.OK:
+				log.Printf("Failed to push %s to %s for %s: %v\n", item.what, remote, item.repo, tok.Results)
+			case dryRun:
+				log.Printf("Would push %s to %s for %s\n", item.what, remote, item.repo)
+			default:
+				log.Printf("Pushed %s to %s for %s\n", item.what, remote, item.repo)
+			}
+			ok = ok && tok.OK
+		}
+		return ok, res
+	}
+	if len(repos) == 0 {
+		return true, make(ResultTokens, 0), nil
+	}
+	return w.repoMapReduce(repos, mapper, reducer)
+}
+
 // See of all our git repositories are clean.
 // Clean means there are no uncommitted changes and no untracked files.
-func IsClean() (ok bool, results ResultTokens) {
-	repos := AllRepos()
-	mapper := func(name string, repo *git.Repo, res resultChan) {
-		ok, items := repo.IsClean()
+func (w *Workspace) IsClean() (ok bool, results ResultTokens, err error) {
+	repos := w.AllRepos()
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
 		tok := makeResultToken()
 		// There is nothing to unwind or rollback when testing to see
 		// if things are clean.
-		tok.Name, tok.OK, tok.Results = name, ok, items
+		tok.Name = name
+		// Refreshing the index is the slow part of checking the
+		// status, so do it in a way that can be cancelled.
+		cmd, _, _ := repo.Git("update-index", "-q", "--refresh")
+		if err := runCmd(ctx, cmd); err != nil && ctx.Err() != nil {
+			tok.OK, tok.Results = false, ctx.Err()
+			res <- tok
+			return
+		}
+		tok.OK, tok.Results = repo.IsClean()
 		res <- tok
 	}
-	ok, results = repoMapReduce(repos, mapper, makeBasicReducer(len(repos)))
+	ok, results, err = w.repoMapReduce(repos, mapper, makeBasicReducer(len(repos)))
 	return
 }
 
+// Make sure all of our repositories are clean before doing something
+// that needs them to be.
+func (w *Workspace) mustBeClean() error {
+	ok, res, err := w.IsClean()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	dirty := make([]string, 0, len(res))
+	for _, tok := range res {
+		if !tok.OK {
+			dirty = append(dirty, tok.Name)
+		}
+	}
+	sort.Strings(dirty)
+	return fmt.Errorf("%w: %s", ErrDirtyRepo, strings.Join(dirty, ", "))
+}
+
 // Get the current build that the repo set is working on.
-func CurrentBuild() Build {
-	res, found := Repo.Get("crowbar.build")
+func (w *Workspace) CurrentBuild() (Build, error) {
+	res, found := w.Repo.Get("crowbar.build")
 	if !found {
-		return nil
+		return nil, ErrNoCurrentBuild
 	}
-	builds := Builds()
+	builds := w.Builds()
 	build, found := builds[res]
 	if !found {
-		log.Fatalf("Current build %s does not exist!", res)
+		return nil, fmt.Errorf("%w: current build %s does not exist", ErrNoSuchBuild, res)
 	}
-	return build
+	return build, nil
 }
 
-func setBuild(build Build) {
-	Repo.Set("crowbar.build", build.FullName())
-	Repo.Set("crowbar.release", build.Release().Name())
+func (w *Workspace) setBuild(build Build) {
+	w.Repo.Set("crowbar.build", build.FullName())
+	w.Repo.Set("crowbar.release", build.Release().Name())
 }
 
 // Rebase local changes on top of changes from upstream fetched by a Fetch.
-func Rebase() (ok bool, res ResultTokens) {
-	repos := AllRepos()
+// All the repositories must be clean.
+func (w *Workspace) Rebase() (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
+	repos := w.AllRepos()
 	log.Println("Rebasing local branches on remote tracking branches")
-	mapper := func(name string, repo *git.Repo, res resultChan) {
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
 		tok := makeResultToken()
 		tok.commit, tok.rollback = branchCheckpointer(repo)
 		tok.Name, tok.OK, tok.Results = name, true, nil
 		for _, branch := range repo.Branches() {
+			if err := ctx.Err(); err != nil {
+				tok.OK, tok.Results = false, err
+				break
+			}
 			upstream, err := branch.TrackedRef()
 			if err != nil {
 				// We don't track anything, don't bother rebasing.
@@ -379,14 +625,30 @@ func Rebase() (ok bool, res ResultTokens) {
 		}
 		res <- tok
 	}
-	ok, res = repoMapReduce(repos, mapper, makeBasicReducer(len(repos)))
+	ok, res, err = w.journaledMapReduce("rebase", repos, mapper, makeBasicReducer(len(repos)))
 	return
 }
 
+// Update fetches all changes from upstream and then rebases local changes
+// on top of them.  The whole thing is journaled as a single operation, so
+// RollbackLast undoes both.  All the repositories must be clean.
+func (w *Workspace) Update() (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
+	return w.journaled("update", w.AllRepos(), func() (bool, ResultTokens, error) {
+		if ok, res, err := w.Fetch(nil); err != nil || !ok {
+			return ok, res, err
+		}
+		return w.Rebase()
+	})
+}
+
 // Get a list of barclamps in a specific Build.
+// A nil Build has no barclamps.
 func BarclampsInBuild(build Build) BarclampMap {
 	if build == nil {
-		log.Panicf("Cannot get barclamps of a nil Build!")
+		return make(BarclampMap)
 	}
 	var res BarclampMap
 	if build.Parent() != nil {
@@ -401,42 +663,42 @@ func BarclampsInBuild(build Build) BarclampMap {
 }
 
 // Clone any missing barclamps we may need.
-func CloneBarclamps() {
+func (w *Workspace) CloneBarclamps() error {
 	barclampsToClone := make(BarclampMap)
 	// Find all our missing barclamps
-	for _,release := range Meta.Releases() {
-		for _,barclamp := range release.Barclamps() {
+	for _, release := range w.Meta.Releases() {
+		for _, barclamp := range release.Barclamps() {
 			if barclamp.Repo != nil {
 				continue
 			}
-			if _,ok := barclampsToClone[barclamp.Name]; ok {
+			if _, ok := barclampsToClone[barclamp.Name]; ok {
 				continue
 			}
-			log.Printf("Need to clone %s\n",barclamp.Name)
-			barclampsToClone[barclamp.Name]=barclamp
+			log.Printf("Need to clone %s\n", barclamp.Name)
+			barclampsToClone[barclamp.Name] = barclamp
 		}
 	}
 	if len(barclampsToClone) == 0 {
 		// Nothing to do, move along.
 		log.Println("No barclamps need to be cloned.")
-		return
+		return nil
 	}
 	type cloneRes struct {
 		name string
 		repo *git.Repo
-		err error
+		err  error
 	}
 	c := make(chan *cloneRes)
 	defer close(c)
-	cloner := func (name string, c chan *cloneRes) {
-		res := &cloneRes{name:name}
-		barclampPath := filepath.Join(Repo.Path(), "barclamps",name)
+	cloner := func(name string, c chan *cloneRes) {
+		res := &cloneRes{name: name}
+		barclampPath := filepath.Join(w.Repo.Path(), "barclamps", name)
 		if _, err := os.Stat(barclampPath); err == nil {
 			res.err = fmt.Errorf("%s already exists, cowardly refusing to clone!", barclampPath)
 			c <- res
 			return
 		}
-		for _, remote := range SortedRemotes() {
+		for _, remote := range w.SortedRemotes() {
 			source := remote.Urlbase + "/barclamp-" + name + ".git"
 			if found, _ := git.ProbeURL(source); !found {
 				continue
@@ -448,39 +710,62 @@ func CloneBarclamps() {
 		res.err = fmt.Errorf("Could not find barclamp %s at any known remotes!", name)
 		c <- res
 	}
-	for _,bc := range barclampsToClone {
-		go cloner(bc.Name,c)
+	for _, bc := range barclampsToClone {
+		go cloner(bc.Name, c)
 	}
-	for _,_ = range barclampsToClone {
-		res := <- c
+	failed := make([]string, 0)
+	for _, _ = range barclampsToClone {
+		res := <-c
 		if res.repo != nil {
-			barclampsToClone[res.name].Repo=res.repo
-			Barclamps[res.name]=res.repo
-			log.Printf("Cloned barclamp %s\n",res.name)
+			barclampsToClone[res.name].Repo = res.repo
+			w.Barclamps[res.name] = res.repo
+			log.Printf("Cloned barclamp %s\n", res.name)
 		} else {
 			log.Println(res.err)
+			failed = append(failed, res.name)
 		}
 	}
-	SyncRemotes()
+	w.SyncRemotes()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Could not clone %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 // Verify that all the barclamps we need for a build have been
 // cloned, and verify that the branches we need are present.
 func VerifyBarclamps(barclamps BarclampMap) error {
-	res := ""
+	problems := make([]string, 0)
 	for _, bc := range barclamps {
 		if bc.Repo == nil {
-			res += fmt.Sprintf("Missing barclamp %s\n", bc.Name)
+			problems = append(problems, fmt.Sprintf("barclamp %s is not cloned", bc.Name))
 			continue
 		}
 		if _, err := bc.Repo.Ref(bc.Branch); err != nil {
-			res += fmt.Sprintf("Barclamp %s does not have branch %s", bc.Name, bc.Branch)
+			problems = append(problems, fmt.Sprintf("barclamp %s does not have branch %s", bc.Name, bc.Branch))
 		}
 	}
-	if res == "" {
+	if len(problems) == 0 {
 		return nil
 	}
-	return fmt.Errorf(res)
+	sort.Strings(problems)
+	return fmt.Errorf("%w: %s", ErrMissingBarclamps, strings.Join(problems, ", "))
+}
+
+// Whether HEAD in a repository is detached rather than on a branch.
+// git symbolic-ref exits with 1 for a detached HEAD, and with something
+// else if it cannot read HEAD at all.
+func detachedHead(r *git.Repo) (bool, error) {
+	cmd, _, stderr := r.Git("symbolic-ref", "-q", "HEAD")
+	err := cmd.Run()
+	if err == nil {
+		return false, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("Cannot read HEAD of %s: %s", r.WorkDir, strings.TrimSpace(stderr.String()))
 }
 
 // Switch a repository to the empty branch, which will be created
@@ -519,46 +804,64 @@ func switchToEmptyBranch(r *git.Repo) error {
 
 // Switch the barclamps to the proper branches for a specific build.
 // Any barclamps not involved in the build will be set to the empty branch.
-func Switch(build Build) (ok bool, res ResultTokens) {
+// All the repositories must be clean, and all the barclamps in the build
+// must have been cloned.
+func (w *Workspace) Switch(build Build) (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
 	newBarclamps := BarclampsInBuild(build)
-	if err := VerifyBarclamps(newBarclamps); err != nil {
-		log.Print(err)
-		log.Fatalln("Please try running dev clone-barclamps to resolve this error.")
+	if err = VerifyBarclamps(newBarclamps); err != nil {
+		return false, nil, err
 	}
 	barclampTargets := make(map[string]string)
-	for name := range Barclamps {
+	for name := range w.Barclamps {
 		if _, found := newBarclamps[name]; found {
 			barclampTargets[name] = newBarclamps[name].Branch
 		} else {
 			barclampTargets[name] = "empty-branch"
 		}
 	}
-	mapper := func(name string, repo *git.Repo, res resultChan) {
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
 		targetBranch := barclampTargets[name]
 		tok := makeResultToken()
 		tok.Name, tok.OK, tok.Results = name, true, nil
+		currentName := "detached HEAD"
 		current, err := repo.CurrentRef()
-		if err != nil {
-			tok.OK = false
-			tok.Results = err
-		} else if current.Name() != targetBranch {
-			tok.Results = fmt.Errorf("Switched %s to %s", current.Name(), targetBranch)
+		if err == nil {
+			currentName = current.Name()
+		} else if detached, derr := detachedHead(repo); derr != nil || !detached {
+			// HEAD is only allowed to be off a branch if we
+			// last switched to a tag or a lock.
+			tok.OK, tok.Results = false, err
+			res <- tok
+			return
+		}
+		if currentName != targetBranch {
+			tok.Results = fmt.Errorf("Switched %s to %s", currentName, targetBranch)
 			if targetBranch == "empty-branch" {
-				if err = switchToEmptyBranch(repo); err != nil {
+				if err := switchToEmptyBranch(repo); err != nil {
 					tok.OK = false
 					tok.Results = err
 				}
-			} else if err = repo.Checkout(targetBranch); err != nil {
-				tok.OK = false
-				tok.Results = err
+			} else {
+				cmd, _, stderr := repo.Git("checkout", "-q", targetBranch)
+				if err := runCmd(ctx, cmd); err != nil {
+					tok.OK = false
+					tok.Results = fmt.Errorf("Cannot check out %s: %s", targetBranch, strings.TrimSpace(stderr.String()))
+				}
 			}
 		}
 		res <- tok
 	}
-	ok, res = repoMapReduce(Barclamps, mapper, makeBasicReducer(len(barclampTargets)))
-	if ok {
-		setBuild(build)
-		build.FinalizeSwitch()
-	}
-	return
+	// Finalize the switch as part of the journaled operation, so that
+	// the switch is only marked committed once everything is done.
+	return w.journaled("switch to "+build.FullName(), w.Barclamps, func() (bool, ResultTokens, error) {
+		ok, res, err := w.repoMapReduce(w.Barclamps, mapper, makeBasicReducer(len(barclampTargets)))
+		if ok && err == nil {
+			w.setBuild(build)
+			err = build.FinalizeSwitch()
+		}
+		return ok, res, err
+	})
 }
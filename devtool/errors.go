@@ -0,0 +1,52 @@
+package devtool
+
+import (
+	"errors"
+)
+
+// Errors that the devtool package can return.
+// Most of the time they will be wrapped with more details about
+// what went wrong, so use errors.Is to test for them.
+var (
+	// Returned when we cannot find a Crowbar checkout.
+	ErrNoCrowbar = errors.New("Cannot find Crowbar")
+	// Returned when asked for a release that does not exist.
+	ErrNoSuchRelease = errors.New("No such release")
+	// Returned when asked for a build that does not exist.
+	ErrNoSuchBuild = errors.New("No such build")
+	// Returned when the current release or build has not been set.
+	ErrNoCurrentBuild = errors.New("No current build")
+	// Returned when a release name cannot be mapped to a branch.
+	ErrInvalidReleaseName = errors.New("Invalid release name")
+	// Returned when an operation needs all the repositories to be clean,
+	// and at least one of them is not.
+	ErrDirtyRepo = errors.New("Crowbar is not clean")
+	// Returned when a build needs barclamps or branches that
+	// have not been cloned yet.
+	ErrMissingBarclamps = errors.New("Missing barclamps")
+	// Returned when a build or changes to a build fail validation.
+	ErrInvalidBuild = errors.New("Invalid build")
+	// Returned when a remote fails validation.
+	ErrInvalidRemote = errors.New("Invalid remote")
+	// Returned when asked for a remote that does not exist.
+	ErrNoSuchRemote = errors.New("No such remote")
+	// Returned when trying to create a remote that already exists.
+	ErrRemoteExists = errors.New("Remote already exists")
+	// Returned when merging one branch into another conflicts.
+	ErrMergeConflict = errors.New("Merge conflict")
+	// Returned when a tag name cannot be used, or is already taken.
+	ErrInvalidTag = errors.New("Invalid tag")
+	// Returned when asked for a tag that no release has.
+	ErrNoSuchTag = errors.New("No such tag")
+	// Returned when a release has not been locked, or the lock
+	// does not cover what it needs to.
+	ErrNoLock = errors.New("No release lock")
+	// Returned when our metadata ref and the one on a remote both have
+	// commits the other does not.
+	ErrMetadataDiverged = errors.New("Release metadata has diverged")
+	// Returned when the metadata for releases and builds is inconsistent.
+	ErrBadMetadata = errors.New("Bad metadata")
+	// Returned when the commit or rollback functions of a repoMapReduce
+	// fail, which leaves things in an inconsistent state.
+	ErrCommitFailed = errors.New("Unable to commit or roll back all operations")
+)
@@ -0,0 +1,38 @@
+package devtool
+
+import (
+	"context"
+	buildutils "github.com/VictorLowther/crowbar-devtool/build"
+	"log"
+)
+
+// FetchExtras puts extras in the build cache one at a time, and returns
+// how many of them could not be fetched.  Like the mappers that
+// repoMapReduce runs, each fetch is cancelled if it runs longer than the
+// timeout, and hitting Ctrl-C cancels the current fetch and skips the rest.
+func (w *Workspace) FetchExtras(extras []*buildutils.Extra) (failed int) {
+	ctx, stop := interruptibleContext()
+	defer stop()
+	limit := w.timeout()
+	for _, extra := range extras {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Skipped %s: %v\n", extra, err)
+			failed++
+			continue
+		}
+		var fctx context.Context
+		var cancel context.CancelFunc
+		if limit > 0 {
+			fctx, cancel = context.WithTimeout(ctx, limit)
+		} else {
+			fctx, cancel = context.WithCancel(ctx)
+		}
+		err := extra.Fetch(fctx)
+		cancel()
+		if err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+	return failed
+}
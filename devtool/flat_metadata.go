@@ -7,21 +7,38 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 // Base type for representing flat metadata.
 type FlatMetadata struct {
+	ws       *Workspace
 	path     string
 	releases map[string]*FlatRelease
 }
 
+// Make a new FlatMetadata for a workspace.  It will not know about
+// any releases until it is probed.
+func newFlatMetadata(w *Workspace) *FlatMetadata {
+	return &FlatMetadata{
+		ws:       w,
+		path:     filepath.Join(w.Repo.Path(), "releases"),
+		releases: make(map[string]*FlatRelease),
+	}
+}
+
 // How we represent a release in the flat metadata.
+// Tags are kept in tag-* files next to the parent file, one line per
+// repository with its name and SHA, and the lock is kept in a lock
+// file in the same format.
 type FlatRelease struct {
 	name, parent string
 	meta         *FlatMetadata
 	builds       map[string]*FlatBuild
+	tags         map[string]Snapshot
+	lock         Snapshot
 }
 
 // How to find the pointer to where the on-disk metadata for this release lives.
@@ -38,24 +55,20 @@ func (r *FlatRelease) Name() string {
 // They will be indexed in the returned BuildMap y build.Name()
 func (r *FlatRelease) Builds() (res BuildMap) {
 	res = make(BuildMap)
-	if r.builds == nil {
-		log.Panicf("Release %s has no builds.", r.name)
-	}
 	for name, build := range r.builds {
 		res[name] = build
 	}
 	return res
 }
 
+// Find the parent FlatRelease of this release.
+// Probe verifies that all parents exist, so this will only return nil
+// if the release has no parent.
 func (r *FlatRelease) lookupParent() (res *FlatRelease) {
 	if r.parent == "" {
 		return nil
 	}
-	if res := r.meta.releases[r.parent]; res != nil {
-		return res
-	}
-	log.Panicf("Parent release %s of %s does not exist!", r.parent, r.name)
-	return nil
+	return r.meta.releases[r.parent]
 }
 
 // Find the parent release of this release.
@@ -69,23 +82,35 @@ func (r *FlatRelease) Parent() Release {
 }
 
 // Sets target to be the new parent of r.
+// If target is nil, r will no longer have a parent.
 func (r *FlatRelease) SetParent(target *FlatRelease) error {
-	buf := bytes.NewBufferString(target.name)
-	if err := ioutil.WriteFile(filepath.Join(r.path(), "parent"),
-		buf.Bytes(),
-		os.FileMode(0644)); err != nil {
-		return err
+	parentPath := filepath.Join(r.path(), "parent")
+	var cmd *exec.Cmd
+	var commitmsg string
+	if target == nil {
+		cmd, _, _ = r.meta.ws.Repo.Git("rm", "-q", r.meta.ws.RelPath(parentPath))
+		commitmsg = fmt.Sprintf("Removed parent of %s", r.name)
+	} else {
+		buf := bytes.NewBufferString(target.name)
+		if err := ioutil.WriteFile(parentPath,
+			buf.Bytes(),
+			os.FileMode(0644)); err != nil {
+			return err
+		}
+		cmd, _, _ = r.meta.ws.Repo.Git("add", r.meta.ws.RelPath(r.path()))
+		commitmsg = fmt.Sprintf("Set parent of %s to %s", r.name, target.name)
 	}
-	relpath := RelPath(r.path())
-	cmd, _, _ := Repo.Git("add", relpath)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	commitmsg := fmt.Sprintf("Set parent of %s to %s", r.name, target.name)
-	cmd, _, _ = Repo.Git("commit", "-m", commitmsg)
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", commitmsg)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
+	r.parent = ""
+	if target != nil {
+		r.parent = target.name
+	}
 	return nil
 }
 
@@ -94,15 +119,17 @@ func (r *FlatRelease) Zap() error {
 	for _, release := range r.meta.releases {
 		if release.parent == r.name {
 			// Reparent any child releases.
-			release.SetParent(r.lookupParent())
+			if err := release.SetParent(r.lookupParent()); err != nil {
+				return err
+			}
 		}
 	}
-	relpath := RelPath(r.path())
-	cmd, _, _ := Repo.Git("rm", "-rf", relpath)
+	relpath := r.meta.ws.RelPath(r.path())
+	cmd, _, _ := r.meta.ws.Repo.Git("rm", "-rf", relpath)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	cmd, _, _ = Repo.Git("commit", "-m", "Removed release "+r.Name())
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", "Removed release "+r.Name())
 	if err := cmd.Run(); err != nil {
 		return err
 	}
@@ -146,6 +173,10 @@ func (r *FlatRelease) FinalizeSplit(name, branch string) (Release, error) {
 			// Make the matching directory in the new release metadata.
 			res = os.MkdirAll(dest, os.FileMode(0755))
 		case info.Mode().IsRegular():
+			if strings.HasPrefix(filepath.Base(path), "tag-") || filepath.Base(path) == "lock" {
+				// Tags and locks belong to the old release.
+				return nil
+			}
 			if strings.HasPrefix(filepath.Base(path), "barclamp-") {
 				// Create a new barclamp- file with the proper branch information.
 				return ioutil.WriteFile(dest, branchBuf.Bytes(), os.FileMode(0644))
@@ -173,20 +204,123 @@ func (r *FlatRelease) FinalizeSplit(name, branch string) (Release, error) {
 	if err != nil {
 		return nil, err
 	}
-	cmd, _, _ := Repo.Git("add", RelPath(newPath))
+	cmd, _, _ := r.meta.ws.Repo.Git("add", r.meta.ws.RelPath(newPath))
 	if err = cmd.Run(); err != nil {
 		return nil, fmt.Errorf("Could not add new release %s in Git", name)
 	}
-	cmd, _, _ = Repo.Git("commit", "-m", fmt.Sprintf("Added new release %s", name))
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", fmt.Sprintf("Added new release %s", name))
 	if err = cmd.Run(); err != nil {
 		return nil, fmt.Errorf("Could not commit addition of new release %s", name)
 	}
-	rel := r.meta.populateRelease(name)
+	rel, err := r.meta.populateRelease(name)
+	if err != nil {
+		return nil, err
+	}
 	r.meta.releases[name] = rel
-	rel.SetParent(r)
+	if err = rel.SetParent(r); err != nil {
+		return nil, err
+	}
 	return Release(rel), nil
 }
 
+// Create the flat metadata for a new build.  This makes the build
+// directory with its barclamp-* files and parent symlink, along with
+// the extra and change-image directories FinalizeSwitch links to.
+func (r *FlatRelease) AddBuild(name string, parent Build, barclamps BarclampMap) (Build, error) {
+	build := &FlatBuild{
+		name:      name,
+		release:   r,
+		barclamps: make(BarclampMap),
+	}
+	bld := build.path()
+	if err := os.MkdirAll(bld, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		build.parent = parent.Name()
+		if err := os.Symlink(filepath.Join("..", build.parent), filepath.Join(bld, "parent")); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{"extra", "change-image"} {
+		if err := os.MkdirAll(filepath.Join(bld, dir), os.FileMode(0755)); err != nil {
+			return nil, err
+		}
+		// Git does not track empty directories.
+		if err := ioutil.WriteFile(filepath.Join(bld, dir, ".gitkeep"), []byte{}, os.FileMode(0644)); err != nil {
+			return nil, err
+		}
+	}
+	for bcName, bc := range barclamps {
+		if err := ioutil.WriteFile(filepath.Join(bld, "barclamp-"+bcName),
+			[]byte(bc.Branch),
+			os.FileMode(0644)); err != nil {
+			return nil, err
+		}
+		build.barclamps[bcName] = bc
+	}
+	cmd, _, _ := r.meta.ws.Repo.Git("add", r.meta.ws.RelPath(bld))
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not add new build %s in Git", build.FullName())
+	}
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", "Added build "+build.FullName())
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Could not commit addition of new build %s", build.FullName())
+	}
+	r.builds[name] = build
+	return Build(build), nil
+}
+
+// The tags of a release.
+func (r *FlatRelease) Tags() map[string]Snapshot {
+	res := make(map[string]Snapshot)
+	for name, snap := range r.tags {
+		res[name] = snap
+	}
+	return res
+}
+
+// Write a tag-* file for a new tag and commit it.
+func (r *FlatRelease) AddTag(name string, snap Snapshot) error {
+	tagPath := filepath.Join(r.path(), "tag-"+name)
+	if err := ioutil.WriteFile(tagPath, snap.format(), os.FileMode(0644)); err != nil {
+		return err
+	}
+	cmd, _, _ := r.meta.ws.Repo.Git("add", r.meta.ws.RelPath(tagPath))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not add tag %s of %s in Git", name, r.name)
+	}
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", fmt.Sprintf("Tagged release %s as %s", r.name, name))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not commit tag %s of %s", name, r.name)
+	}
+	r.tags[name] = snap
+	return nil
+}
+
+// The lock of a release.
+func (r *FlatRelease) Lock() Snapshot {
+	return r.lock
+}
+
+// Write the lock file for a release and commit it.
+func (r *FlatRelease) SetLock(snap Snapshot) error {
+	lockPath := filepath.Join(r.path(), "lock")
+	if err := ioutil.WriteFile(lockPath, snap.format(), os.FileMode(0644)); err != nil {
+		return err
+	}
+	cmd, _, _ := r.meta.ws.Repo.Git("add", r.meta.ws.RelPath(lockPath))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not add lock for %s in Git", r.name)
+	}
+	cmd, _, _ = r.meta.ws.Repo.Git("commit", "-m", "Locked release "+r.name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not commit lock for %s", r.name)
+	}
+	r.lock = snap
+	return nil
+}
+
 // How we represent a build in the flat metadata.
 type FlatBuild struct {
 	name, parent string
@@ -212,22 +346,16 @@ func (b *FlatBuild) FullName() string {
 
 // The release that this build is a part of.
 func (b *FlatBuild) Release() Release {
-	if b.release == nil {
-		log.Panicf("Build %s is not a member of any release!", b.name)
-	}
 	return Release(b.release)
 }
 
 // The parent build of this one.
+// Probe verifies that all parents exist, so this will only return nil
+// if the build has no parent.
 func (b *FlatBuild) Parent() Build {
-	if b.parent == "" {
-		return nil
-	}
 	if res := b.release.builds[b.parent]; res != nil {
 		return Build(res)
 	}
-	log.Panicf("Release %s: cannot find parent build %s of build %s!",
-		b.release.name, b.parent, b.name)
 	return nil
 }
 
@@ -238,17 +366,8 @@ func (b *FlatBuild) Barclamps() BarclampMap {
 
 // Perform switch finalization for FlatMetadata.
 // Currently, this involves recreating the extras and change-image symlinks.
-func (b *FlatBuild) FinalizeSwitch() {
-	pwd, err := os.Getwd()
-	if err != nil {
-		log.Panic(err)
-	}
-	defer os.Chdir(pwd)
-	os.Chdir(Repo.WorkDir)
-	for _, link := range []string{"change-image", "extra"} {
-		os.Remove(link)
-		os.Symlink(filepath.Join(b.path(), link), link)
-	}
+func (b *FlatBuild) FinalizeSwitch() error {
+	return b.release.meta.ws.linkBuildExtras(b.path())
 }
 
 // Zap a build.  This erases the build metadata from the disk.
@@ -258,13 +377,13 @@ func (b *FlatBuild) Zap() error {
 			return fmt.Errorf("Cannot delete build with active children!")
 		}
 	}
-	cbPath := filepath.Clean(Repo.WorkDir) + "/"
+	cbPath := filepath.Clean(b.release.meta.ws.Repo.WorkDir) + "/"
 	relpath := strings.TrimPrefix(b.path(), cbPath)
-	cmd, _, _ := Repo.Git("rm", "-rf", relpath)
+	cmd, _, _ := b.release.meta.ws.Repo.Git("rm", "-rf", relpath)
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	cmd, _, _ = Repo.Git("commit", "-m", "Removed build "+b.FullName())
+	cmd, _, _ = b.release.meta.ws.Repo.Git("commit", "-m", "Removed build "+b.FullName())
 	if err := cmd.Run(); err != nil {
 		return err
 	}
@@ -273,12 +392,53 @@ func (b *FlatBuild) Zap() error {
 	return nil
 }
 
+// Add or update the barclamp-* file for a barclamp, and commit it.
+func (b *FlatBuild) SetBarclamp(bc *Barclamp) error {
+	commitmsg := fmt.Sprintf("Added barclamp %s on %s to build %s", bc.Name, bc.Branch, b.FullName())
+	if old, found := b.barclamps[bc.Name]; found {
+		commitmsg = fmt.Sprintf("Changed barclamp %s in build %s from %s to %s",
+			bc.Name, b.FullName(), old.Branch, bc.Branch)
+	}
+	bcPath := filepath.Join(b.path(), "barclamp-"+bc.Name)
+	if err := ioutil.WriteFile(bcPath, []byte(bc.Branch), os.FileMode(0644)); err != nil {
+		return err
+	}
+	ws := b.release.meta.ws
+	cmd, _, _ := ws.Repo.Git("add", ws.RelPath(bcPath))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not add %s in Git", ws.RelPath(bcPath))
+	}
+	cmd, _, _ = ws.Repo.Git("commit", "-m", commitmsg)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not commit: %s", commitmsg)
+	}
+	b.barclamps[bc.Name] = bc
+	return nil
+}
+
+// Remove the barclamp-* file for a barclamp, and commit the removal.
+func (b *FlatBuild) RemoveBarclamp(name string) error {
+	if _, found := b.barclamps[name]; !found {
+		return fmt.Errorf("%w: barclamp %s is not in build %s", ErrInvalidBuild, name, b.FullName())
+	}
+	ws := b.release.meta.ws
+	bcPath := ws.RelPath(filepath.Join(b.path(), "barclamp-"+name))
+	cmd, _, _ := ws.Repo.Git("rm", "-q", bcPath)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not remove %s from Git", bcPath)
+	}
+	commitmsg := fmt.Sprintf("Removed barclamp %s from build %s", name, b.FullName())
+	cmd, _, _ = ws.Repo.Git("commit", "-m", commitmsg)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not commit: %s", commitmsg)
+	}
+	delete(b.barclamps, name)
+	return nil
+}
+
 // Get a list of releases that this metadata knows about
 func (m *FlatMetadata) Releases() ReleaseMap {
 	res := make(ReleaseMap)
-	if m.releases == nil {
-		log.Panicf("No releases available")
-	}
 	for name, rel := range m.releases {
 		res[name] = rel
 	}
@@ -297,7 +457,7 @@ func (m *FlatMetadata) AllBuilds() map[string]*FlatBuild {
 	return res
 }
 
-func (m *FlatMetadata) populateBuild(release *FlatRelease, name string) *FlatBuild {
+func (m *FlatMetadata) populateBuild(release *FlatRelease, name string) (*FlatBuild, error) {
 	build := &FlatBuild{
 		name:      name,
 		release:   release,
@@ -314,11 +474,13 @@ func (m *FlatMetadata) populateBuild(release *FlatRelease, name string) *FlatBui
 	}
 	glob := filepath.Join(bld, "barclamp-*")
 	barclamps, err := filepath.Glob(glob)
-	dieIfError(err)
+	if err != nil {
+		return nil, err
+	}
 	for _, bc := range barclamps {
 		barclamp := &Barclamp{}
 		barclamp.Name = strings.TrimPrefix(bc, filepath.Join(bld, "barclamp-"))
-		barclamp.Repo = Barclamps[barclamp.Name]
+		barclamp.Repo = m.ws.Barclamps[barclamp.Name]
 		branch, err := ioutil.ReadFile(bc)
 		if err != nil {
 			continue
@@ -327,14 +489,15 @@ func (m *FlatMetadata) populateBuild(release *FlatRelease, name string) *FlatBui
 		barclamp.Branch = strings.TrimSpace(buf.String())
 		build.barclamps[barclamp.Name] = barclamp
 	}
-	return build
+	return build, nil
 }
 
-func (m *FlatMetadata) populateRelease(rel string) *FlatRelease {
+func (m *FlatMetadata) populateRelease(rel string) (*FlatRelease, error) {
 	release := &FlatRelease{
 		meta:   m,
 		name:   rel,
 		builds: make(map[string]*FlatBuild),
+		tags:   make(map[string]Snapshot),
 	}
 	prefix := release.path()
 	glob := filepath.Join(prefix, "*/")
@@ -347,20 +510,53 @@ func (m *FlatMetadata) populateRelease(rel string) *FlatRelease {
 			release.parent = strings.TrimSpace(buf.String())
 		}
 	}
+	tags, err := filepath.Glob(filepath.Join(prefix, "tag-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tagPath := range tags {
+		buf, err := ioutil.ReadFile(tagPath)
+		if err != nil {
+			return nil, err
+		}
+		snap, err := parseSnapshot(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadMetadata, tagPath, err)
+		}
+		release.tags[strings.TrimPrefix(filepath.Base(tagPath), "tag-")] = snap
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(prefix, "lock")); err == nil {
+		if release.lock, err = parseSnapshot(buf); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadMetadata, filepath.Join(prefix, "lock"), err)
+		}
+	}
 	builds, err := filepath.Glob(glob)
-	dieIfError(err)
+	if err != nil {
+		return nil, err
+	}
 	for _, bld := range builds {
+		// The glob matches files like parent, lock, and tag-* as well.
+		if stat, err := os.Stat(bld); err != nil || !stat.IsDir() {
+			continue
+		}
 		bld = strings.Trim(strings.TrimPrefix(bld, prefix), "/")
-		build := m.populateBuild(release, bld)
-		dieIfError(err)
+		build, err := m.populateBuild(release, bld)
+		if err != nil {
+			return nil, err
+		}
 		release.builds[bld] = build
 	}
-	return release
+	for _, build := range release.builds {
+		if build.parent != "" && release.builds[build.parent] == nil {
+			return nil, fmt.Errorf("%w: cannot find parent build %s of %s",
+				ErrBadMetadata, build.parent, build.FullName())
+		}
+	}
+	return release, nil
 }
 
 // Populate the Releases field of a Crowbar struct, if we are using flat metadata.
 func (m *FlatMetadata) Probe() (err error) {
-	m.path = filepath.Join(Repo.Path(), "releases")
 	m.releases = make(map[string]*FlatRelease)
 	stat, err := os.Lstat(m.path)
 	if err != nil {
@@ -376,11 +572,110 @@ func (m *FlatMetadata) Probe() (err error) {
 	for _, g := range [...]string{"*/", "feature/*/"} {
 		glob := filepath.Join(m.path, g)
 		releases, err := filepath.Glob(glob)
-		dieIfError(err)
+		if err != nil {
+			return err
+		}
 		for _, rel := range releases {
 			rel = strings.Trim(strings.TrimPrefix(rel, m.path), "/")
-			m.releases[rel] = m.populateRelease(rel)
+			if m.releases[rel], err = m.populateRelease(rel); err != nil {
+				return err
+			}
 		}
 	}
+	for _, rel := range m.releases {
+		if rel.parent != "" && m.releases[rel.parent] == nil {
+			return fmt.Errorf("%w: parent release %s of %s does not exist",
+				ErrBadMetadata, rel.parent, rel.name)
+		}
+	}
+	return nil
+}
+
+// The name of the flat metadata backend.
+func (m *FlatMetadata) backendName() string {
+	return "flat"
+}
+
+// Write out releases and builds from another Metadata as
+// directories of barclamp-* files, parent files, and parent symlinks.
+func (m *FlatMetadata) importFrom(src Metadata) error {
+	for _, rel := range src.Releases() {
+		relPath := filepath.Join(m.path, rel.Name())
+		if err := os.MkdirAll(relPath, os.FileMode(0755)); err != nil {
+			return err
+		}
+		if parent := rel.Parent(); parent != nil {
+			if err := ioutil.WriteFile(filepath.Join(relPath, "parent"),
+				[]byte(parent.Name()),
+				os.FileMode(0644)); err != nil {
+				return err
+			}
+		}
+		if lock := rel.Lock(); lock != nil {
+			if err := ioutil.WriteFile(filepath.Join(relPath, "lock"),
+				lock.format(),
+				os.FileMode(0644)); err != nil {
+				return err
+			}
+		}
+		for tag, snap := range rel.Tags() {
+			if err := ioutil.WriteFile(filepath.Join(relPath, "tag-"+tag),
+				snap.format(),
+				os.FileMode(0644)); err != nil {
+				return err
+			}
+		}
+		for _, build := range rel.Builds() {
+			buildPath := filepath.Join(relPath, build.Name())
+			if err := os.MkdirAll(buildPath, os.FileMode(0755)); err != nil {
+				return err
+			}
+			if parent := build.Parent(); parent != nil {
+				parentLink := filepath.Join(buildPath, "parent")
+				os.Remove(parentLink)
+				if err := os.Symlink(filepath.Join("..", parent.Name()), parentLink); err != nil {
+					return err
+				}
+			}
+			for name, bc := range build.Barclamps() {
+				if err := ioutil.WriteFile(filepath.Join(buildPath, "barclamp-"+name),
+					[]byte(bc.Branch),
+					os.FileMode(0644)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cmd, _, _ := m.ws.Repo.Git("add", m.ws.RelPath(m.path))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not add flat metadata in Git")
+	}
+	return nil
+}
+
+// Remove the barclamp-*, tag-*, and lock files and parent links from the flat metadata.
+// Anything else (such as the extra and change-image directories) is left alone.
+func (m *FlatMetadata) remove() error {
+	paths := make([]string, 0, 20)
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(path)
+		if !info.IsDir() && (base == "parent" || strings.HasPrefix(base, "barclamp-") || strings.HasPrefix(base, "tag-") || base == "lock") {
+			paths = append(paths, m.ws.RelPath(path))
+		}
+		return nil
+	}
+	if err := filepath.Walk(m.path, walker); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	cmd, _, _ := m.ws.Repo.Git("rm", append([]string{"-q", "--"}, paths...)...)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not remove flat metadata from Git")
+	}
 	return nil
 }
@@ -0,0 +1,458 @@
+package devtool
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/VictorLowther/go-git/git"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// States that a journal can be in.
+const (
+	// The operation is running, or it was killed before it could finish.
+	journalRunning = "running"
+	// The operation finished and its changes were kept.
+	journalCommitted = "committed"
+	// The operation finished and its changes were rolled back.
+	journalRolledBack = "rolled-back"
+	// The journal was replayed by Recover or RollbackLast.
+	journalReplayed = "replayed"
+)
+
+// repoSnapshot records the state of a single repository before
+// a journaled operation started mucking with it.
+type repoSnapshot struct {
+	// The path to the working directory of the repository.
+	Path string
+	// The branch (or SHA if HEAD was detached) that was checked out.
+	Ref string
+	// The SHAs that all the local branches pointed at.
+	Branches map[string]string
+	// The contents of the git config file.
+	Config string
+	// The SHA that the release metadata ref pointed at, or empty if
+	// the repository did not have one.
+	Metadata string `json:",omitempty"`
+	// The SHAs that all the local branches pointed at when the
+	// operation finished, so that RollbackLast can tell if anything
+	// has been done to them since.
+	After map[string]string `json:",omitempty"`
+	// The SHA that the release metadata ref pointed at when the
+	// operation finished.
+	AfterMetadata string `json:",omitempty"`
+}
+
+// journal is what we write out to disk for each journaled operation.
+type journal struct {
+	Operation string
+	Started   time.Time
+	State     string
+	Repos     map[string]*repoSnapshot
+	// Where this journal is saved.
+	path string
+	// How many operations nested in this one have finished successfully.
+	committed int
+}
+
+// Where the journal lives.
+func (w *Workspace) journalPath() string {
+	return filepath.Join(w.Repo.GitDir, "crowbar-journal")
+}
+
+// Figure out what is checked out in a repository.
+func headOf(r *git.Repo) (string, error) {
+	if ref, err := r.CurrentRef(); err == nil {
+		return ref.Name(), nil
+	}
+	cmd, out, _ := r.Git("rev-parse", "HEAD")
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Cannot find HEAD of %s", r.WorkDir)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// Take a snapshot of a repository.
+func snapshotRepo(r *git.Repo) (*repoSnapshot, error) {
+	head, err := headOf(r)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ioutil.ReadFile(filepath.Join(r.GitDir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	res := &repoSnapshot{
+		Path:     r.WorkDir,
+		Ref:      head,
+		Branches: make(map[string]string),
+		Config:   string(config),
+		Metadata: metadataSHA(r),
+	}
+	res.Branches = branchSHAs(r)
+	return res, nil
+}
+
+// Get the SHAs that all the local branches in a repository point at.
+func branchSHAs(r *git.Repo) map[string]string {
+	res := make(map[string]string)
+	for _, ref := range r.Branches() {
+		res[ref.Name()] = ref.SHA
+	}
+	return res
+}
+
+// Get the SHA that the release metadata ref points at in a repository,
+// or an empty string if it does not have one.
+func metadataSHA(r *git.Repo) string {
+	cmd, out, _ := r.Git("rev-parse", "-q", "--verify", metadataRef)
+	if cmd.Run() != nil {
+		return ""
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// Find the branches that have changed since the operation finished,
+// including ones that have been created or deleted since.  If the
+// release metadata ref has changed, it is included by its full name.
+func (s *repoSnapshot) moved() ([]string, error) {
+	r, err := git.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	now := branchSHAs(r)
+	res := make([]string, 0)
+	for name, sha := range now {
+		if s.After[name] != sha {
+			res = append(res, name)
+		}
+	}
+	for name := range s.After {
+		if _, found := now[name]; !found {
+			res = append(res, name)
+		}
+	}
+	if metadataSHA(r) != s.AfterMetadata {
+		res = append(res, metadataRef)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Find out if the index or work tree of a repository has changes that
+// restoring it would throw away.
+func (s *repoSnapshot) dirty() (bool, error) {
+	r, err := git.Open(s.Path)
+	if err != nil {
+		return false, err
+	}
+	cmd, out, _ := r.Git("status", "--porcelain")
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("Cannot get the status of %s", s.Path)
+	}
+	return strings.TrimSpace(out.String()) != "", nil
+}
+
+// Put a repository back the way it was when the snapshot was taken.
+// Any rebase in progress is aborted, the config file is restored,
+// all the branches in the snapshot and the release metadata ref are
+// reset to their old SHAs,
+// whatever was checked out is checked out again (throwing away any
+// changes to the index and work tree), and any branches
+// that were created since the snapshot are deleted.
+func (s *repoSnapshot) restore() error {
+	r, err := git.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		if _, err := os.Stat(filepath.Join(r.GitDir, dir)); err == nil {
+			cmd, _, _ := r.Git("rebase", "--abort")
+			if cmd.Run() != nil {
+				return fmt.Errorf("Could not abort rebase in %s", s.Path)
+			}
+			break
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.GitDir, "config"), []byte(s.Config), os.FileMode(0644)); err != nil {
+		return err
+	}
+	r.ReloadConfig()
+	// Get off whatever branch is checked out before moving the branches,
+	// and throw away anything the operation left in the index and work
+	// tree.  Otherwise moving the current branch would leave them at the
+	// newer commit, looking like changes that undo the rollback.
+	cmd, _, _ := r.Git("checkout", "-q", "-f", "--detach")
+	if cmd.Run() != nil {
+		return fmt.Errorf("Could not detach HEAD in %s", s.Path)
+	}
+	for name, sha := range s.Branches {
+		cmd, _, _ := r.Git("update-ref", "refs/heads/"+name, sha)
+		if cmd.Run() != nil {
+			return fmt.Errorf("Could not reset branch %s in %s to %s", name, s.Path, sha)
+		}
+	}
+	switch {
+	case s.Metadata != "":
+		cmd, _, _ := r.Git("update-ref", metadataRef, s.Metadata)
+		if cmd.Run() != nil {
+			return fmt.Errorf("Could not reset %s in %s to %s", metadataRef, s.Path, s.Metadata)
+		}
+	case metadataSHA(r) != "":
+		cmd, _, _ := r.Git("update-ref", "-d", metadataRef)
+		if cmd.Run() != nil {
+			return fmt.Errorf("Could not delete %s in %s", metadataRef, s.Path)
+		}
+	}
+	cmd, _, _ = r.Git("checkout", "-q", "-f", s.Ref)
+	if cmd.Run() != nil {
+		return fmt.Errorf("Could not check out %s in %s", s.Ref, s.Path)
+	}
+	for _, ref := range r.Branches() {
+		if _, found := s.Branches[ref.Name()]; found {
+			continue
+		}
+		cmd, _, _ := r.Git("update-ref", "-d", "refs/heads/"+ref.Name())
+		if cmd.Run() != nil {
+			return fmt.Errorf("Could not delete branch %s in %s", ref.Name(), s.Path)
+		}
+	}
+	return nil
+}
+
+// Load the journal from disk.  Returns nil if there is no journal.
+func (w *Workspace) loadJournal() (*journal, error) {
+	buf, err := ioutil.ReadFile(w.journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := &journal{path: w.journalPath()}
+	if err = json.Unmarshal(buf, res); err != nil {
+		return nil, fmt.Errorf("Journal %s is corrupt: %v", w.journalPath(), err)
+	}
+	return res, nil
+}
+
+// Write the journal out to disk.
+// We write to a temporary file and rename it so that we never leave
+// a half-written journal behind.
+func (j *journal) save() error {
+	buf, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Snapshot every repository in repos that the journal does not already
+// have a snapshot of.  Snapshots are keyed by path, since the names in
+// repos may collide with each other depending on the operation.
+func (j *journal) add(w *Workspace, repos RepoMap) error {
+	added := false
+	for _, repo := range repos {
+		name := "crowbar"
+		if repo != w.Repo {
+			name = w.RelPath(repo.WorkDir)
+		}
+		if _, found := j.Repos[name]; found {
+			continue
+		}
+		snap, err := snapshotRepo(repo)
+		if err != nil {
+			return fmt.Errorf("Cannot journal %s: %v", name, err)
+		}
+		j.Repos[name], added = snap, true
+	}
+	if !added {
+		return nil
+	}
+	if err := j.save(); err != nil {
+		return fmt.Errorf("Cannot write journal %s: %v", j.path, err)
+	}
+	return nil
+}
+
+// Restore every repository in the journal to its recorded state.
+func (j *journal) restore() error {
+	failed := make([]string, 0)
+	for name, snap := range j.Repos {
+		if err := snap.restore(); err != nil {
+			log.Printf("%s: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		log.Printf("Restored %s\n", name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not restore %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Restore every repository in the journal, and record that we did.
+func (j *journal) replay() error {
+	if err := j.restore(); err != nil {
+		return err
+	}
+	j.State = journalReplayed
+	return j.save()
+}
+
+// Run fn as a single journaled operation, recording the state of all the
+// repositories in repos (and the main Crowbar repository) on disk before
+// doing anything.  If we get killed partway through, Recover can use the
+// journal to put everything back the way it was, and RollbackLast can use
+// it to undo the operation after it has finished.
+//
+// Journaled operations that fn performs are folded into this one instead
+// of replacing its journal, so RollbackLast undoes all of fn.  If fn fails
+// after some of them finished, everything is put back the way it was.
+func (w *Workspace) journaled(op string, repos RepoMap, fn func() (bool, ResultTokens, error)) (ok bool, res ResultTokens, err error) {
+	if j := w.journal; j != nil {
+		if err = j.add(w, repos); err != nil {
+			return false, nil, err
+		}
+		ok, res, err = fn()
+		if ok && err == nil {
+			j.committed++
+		}
+		return ok, res, err
+	}
+	old, err := w.loadJournal()
+	if err != nil {
+		return false, nil, err
+	}
+	if old != nil && old.State == journalRunning {
+		return false, nil, fmt.Errorf("An interrupted %s left Crowbar in an inconsistent state, please run dev recover", old.Operation)
+	}
+	j := &journal{
+		Operation: op,
+		Started:   time.Now(),
+		State:     journalRunning,
+		Repos:     make(map[string]*repoSnapshot),
+		path:      w.journalPath(),
+	}
+	if err = j.add(w, RepoMap{"crowbar": w.Repo}); err != nil {
+		return false, nil, err
+	}
+	if err = j.add(w, repos); err != nil {
+		return false, nil, err
+	}
+	w.journal = j
+	ok, res, err = fn()
+	w.journal = nil
+	if err != nil {
+		// Leave the journal marked as running so that Recover can
+		// clean up after the failed commit or rollback.
+		return ok, res, err
+	}
+	if !ok && j.committed > 0 {
+		// The steps that failed rolled themselves back,
+		// but the ones before them did not.
+		if err = j.restore(); err != nil {
+			return ok, res, err
+		}
+	}
+	if ok {
+		j.State = journalCommitted
+		for name, snap := range j.Repos {
+			r, err := git.Open(snap.Path)
+			if err != nil {
+				log.Printf("Cannot record the final state of %s: %v\n", name, err)
+				continue
+			}
+			snap.After = branchSHAs(r)
+			snap.AfterMetadata = metadataSHA(r)
+		}
+	} else {
+		j.State = journalRolledBack
+	}
+	if err = j.save(); err != nil {
+		log.Printf("Cannot update journal %s: %v\n", w.journalPath(), err)
+	}
+	return ok, res, nil
+}
+
+// Perform a repoMapReduce as a journaled operation.
+func (w *Workspace) journaledMapReduce(op string, repos RepoMap, mapper repoMapper, reducer repoReducer) (ok bool, res ResultTokens, err error) {
+	return w.journaled(op, repos, func() (bool, ResultTokens, error) {
+		return w.repoMapReduce(repos, mapper, reducer)
+	})
+}
+
+// Recover puts everything back the way it was before an operation
+// that was killed before it could finish.
+func (w *Workspace) Recover() error {
+	j, err := w.loadJournal()
+	if err != nil {
+		return err
+	}
+	if j == nil || j.State != journalRunning {
+		log.Println("No interrupted operations to recover from.")
+		return nil
+	}
+	log.Printf("Recovering from %s interrupted at %s\n", j.Operation, j.Started.Format(time.RFC1123))
+	return j.replay()
+}
+
+// RollbackLast undoes the last journaled operation that finished
+// successfully.  If any branch has changed since the operation finished,
+// or any repository has uncommitted changes, rolling back would throw
+// those changes away, so we refuse to unless force is true.  We also
+// refuse if we could not record what a repository looked like when the
+// operation finished, since then we cannot tell what would be lost.
+func (w *Workspace) RollbackLast(force bool) error {
+	j, err := w.loadJournal()
+	if err != nil {
+		return err
+	}
+	switch {
+	case j == nil:
+		return fmt.Errorf("No journaled operations to roll back.")
+	case j.State == journalRunning:
+		return fmt.Errorf("The last %s was interrupted, please run dev recover instead.", j.Operation)
+	case j.State != journalCommitted:
+		return fmt.Errorf("The last %s was already rolled back.", j.Operation)
+	}
+	if !force {
+		changed := make([]string, 0)
+		for name, snap := range j.Repos {
+			if snap.After == nil {
+				changed = append(changed, name+" (final state unknown)")
+				continue
+			}
+			moved, err := snap.moved()
+			if err != nil {
+				return err
+			}
+			for _, branch := range moved {
+				changed = append(changed, name+":"+branch)
+			}
+			dirty, err := snap.dirty()
+			if err != nil {
+				return err
+			}
+			if dirty {
+				changed = append(changed, name+" (uncommitted changes)")
+			}
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			return fmt.Errorf("Crowbar has changed since the last %s, rolling back would lose those changes: %s",
+				j.Operation, strings.Join(changed, ", "))
+		}
+	}
+	log.Printf("Rolling back %s from %s\n", j.Operation, j.Started.Format(time.RFC1123))
+	return j.replay()
+}
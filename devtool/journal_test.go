@@ -0,0 +1,206 @@
+package devtool
+
+import (
+	"github.com/VictorLowther/go-git/git"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run git in dir, failing the test if it fails.
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Commit contents to file in dir.
+func testCommit(t *testing.T, dir, file, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "add", file)
+	testGit(t, dir, "commit", "-q", "-m", "Changed "+file)
+}
+
+// Make a repository with master checked out, one local commit on master,
+// and an upstream branch that master can be rebased onto.  If conflict is
+// true, the rebase will stop partway through.
+func testSyncRepo(t *testing.T, conflict bool) string {
+	dir, err := ioutil.TempDir("", "devtool-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "init", "-q", "-b", "master")
+	testGit(t, dir, "config", "user.name", "Journal Test")
+	testGit(t, dir, "config", "user.email", "journal@example.com")
+	testCommit(t, dir, "README", "base\n")
+	testGit(t, dir, "checkout", "-q", "-b", "upstream")
+	testCommit(t, dir, "upstream", "upstream\n")
+	if conflict {
+		testCommit(t, dir, "README", "upstream\n")
+	}
+	testGit(t, dir, "checkout", "-q", "master")
+	testCommit(t, dir, "README", "local\n")
+	return dir
+}
+
+func TestRestoreAfterSync(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict bool
+	}{
+		{name: "finished sync", conflict: false},
+		{name: "interrupted sync", conflict: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testSyncRepo(t, test.conflict)
+			defer os.RemoveAll(dir)
+			before := testGit(t, dir, "rev-parse", "HEAD")
+			testGit(t, dir, "update-ref", metadataRef, "HEAD")
+			r, err := git.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap, err := snapshotRepo(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Do what sync does to the checked-out branch, and
+			// leave a new branch behind for good measure.
+			testGit(t, dir, "branch", "extra")
+			testGit(t, dir, "update-ref", metadataRef, "upstream")
+			rebase := exec.Command("git", "rebase", "-q", "upstream")
+			rebase.Dir = dir
+			if err := rebase.Run(); (err != nil) != test.conflict {
+				t.Fatalf("Expected the rebase to fail to be %v, got %v", test.conflict, err)
+			}
+			if err := snap.restore(); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			if status := testGit(t, dir, "status", "--porcelain"); status != "" {
+				t.Errorf("Expected a clean work tree, got:\n%s", status)
+			}
+			if head := testGit(t, dir, "rev-parse", "HEAD"); head != before {
+				t.Errorf("Expected HEAD to be back at %s, got %s", before, head)
+			}
+			if branch := testGit(t, dir, "symbolic-ref", "HEAD"); branch != "refs/heads/master" {
+				t.Errorf("Expected master to be checked out, got %s", branch)
+			}
+			if branches := testGit(t, dir, "branch", "--list", "extra"); branches != "" {
+				t.Errorf("Expected the extra branch to be deleted")
+			}
+			if meta := testGit(t, dir, "rev-parse", metadataRef); meta != before {
+				t.Errorf("Expected %s to be back at %s, got %s", metadataRef, before, meta)
+			}
+		})
+	}
+}
+
+func TestMovedSinceOperation(t *testing.T) {
+	dir := testSyncRepo(t, false)
+	defer os.RemoveAll(dir)
+	r, err := git.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := snapshotRepo(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.After = branchSHAs(r)
+	snap.AfterMetadata = metadataSHA(r)
+	if moved, err := snap.moved(); err != nil || len(moved) != 0 {
+		t.Fatalf("Expected nothing to have moved, got %v, %v", moved, err)
+	}
+	testCommit(t, dir, "README", "later\n")
+	testGit(t, dir, "branch", "later")
+	testGit(t, dir, "branch", "-D", "upstream")
+	testGit(t, dir, "update-ref", metadataRef, "HEAD")
+	moved, err := snap.moved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "later,master," + metadataRef + ",upstream"; strings.Join(moved, ",") != expected {
+		t.Errorf("Expected %s to have moved, got %v", expected, moved)
+	}
+}
+
+func TestRollbackLastRefusesChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string, snap *repoSnapshot)
+	}{
+		{
+			name: "moved branch",
+			change: func(t *testing.T, dir string, snap *repoSnapshot) {
+				testCommit(t, dir, "README", "later\n")
+			},
+		},
+		{
+			name: "uncommitted edit",
+			change: func(t *testing.T, dir string, snap *repoSnapshot) {
+				if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("later\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "unknown final state",
+			change: func(t *testing.T, dir string, snap *repoSnapshot) {
+				snap.After = nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testSyncRepo(t, false)
+			defer os.RemoveAll(dir)
+			r, err := git.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &Workspace{Repo: r}
+			snap, err := snapshotRepo(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testGit(t, dir, "reset", "-q", "--hard", "upstream")
+			snap.After = branchSHAs(r)
+			test.change(t, dir, snap)
+			j := &journal{
+				Operation: "sync",
+				State:     journalCommitted,
+				Repos:     map[string]*repoSnapshot{"crowbar": snap},
+				path:      w.journalPath(),
+			}
+			if err := j.save(); err != nil {
+				t.Fatal(err)
+			}
+			status := testGit(t, dir, "status", "--porcelain")
+			head := testGit(t, dir, "rev-parse", "HEAD")
+			if err := w.RollbackLast(false); err == nil {
+				t.Fatalf("Expected the rollback to be refused")
+			}
+			if now := testGit(t, dir, "status", "--porcelain"); now != status {
+				t.Errorf("Expected the work tree to be left alone, got:\n%s", now)
+			}
+			if now := testGit(t, dir, "rev-parse", "HEAD"); now != head {
+				t.Errorf("Expected HEAD to be left at %s, got %s", head, now)
+			}
+			if err := w.RollbackLast(true); err != nil {
+				t.Fatalf("Expected a forced rollback to work, got %v", err)
+			}
+		})
+	}
+}
@@ -1,11 +1,19 @@
 package devtool
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/VictorLowther/go-git/git"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
 )
 
 // The result type that all mappers in the repoMapReduce framework expect.
@@ -28,6 +36,31 @@ type ResultToken struct {
 	Results interface{}
 }
 
+// MarshalJSON renders a ResultToken as a JSON object with name, ok,
+// and results keys.  Errors and git.StatLines are translated into
+// strings, since encoding/json cannot make sense of them on its own.
+func (t *ResultToken) MarshalJSON() ([]byte, error) {
+	doc := struct {
+		Name    string      `json:"name"`
+		OK      bool        `json:"ok"`
+		Results interface{} `json:"results,omitempty"`
+	}{Name: t.Name, OK: t.OK}
+	switch r := t.Results.(type) {
+	case nil:
+	case error:
+		doc.Results = r.Error()
+	case git.StatLines:
+		lines := make([]string, 0, len(r))
+		for _, line := range r {
+			lines = append(lines, line.Print())
+		}
+		doc.Results = lines
+	default:
+		doc.Results = r
+	}
+	return json.Marshal(doc)
+}
+
 func noopCommit(c chan<- bool) { c <- true }
 
 // Make a default ResultToken.
@@ -40,23 +73,48 @@ func makeResultToken() (res *ResultToken) {
 	return
 }
 
+// Make a ResultToken for a repository whose mapper was cancelled
+// (or never started) because the operation was interrupted or timed out.
+// There is nothing to roll back, so the default commit and rollback are used.
+func makeCancelledToken(name string, err error) (res *ResultToken) {
+	res = makeResultToken()
+	res.Name, res.OK, res.Results = name, false, err
+	return
+}
+
+// Run a command, killing it if ctx is cancelled before the command finishes.
+// Mappers should use this instead of cmd.Run() for anything that might hang.
+func runCmd(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return ctx.Err()
+	}
+}
+
 // Make commit and rollback functions for things that mess with
 // the git config file.  This works by saving the contents of the
 // git config file, and then discarding the saved changes or writing them out.
-func configCheckpointer(r *git.Repo) (commit, rollback func(chan<- bool)) {
+func configCheckpointer(r *git.Repo) (commit, rollback func(chan<- bool), err error) {
 	configPath := filepath.Join(r.GitDir, "config")
 	stat, err := os.Stat(configPath)
 	if err != nil {
-		log.Printf("Error stat'ing %s:\n", configPath)
-		panic(err)
+		return nil, nil, err
 	}
 	if !stat.Mode().IsRegular() {
-		log.Panicf("Git config file %s is not a file!\n", configPath)
+		return nil, nil, fmt.Errorf("Git config file %s is not a file!", configPath)
 	}
 	configContents, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		log.Printf("Error opening %s\n", configPath)
-		panic(err)
+		return nil, nil, err
 	}
 	// By now we have saved the current config file contents.
 	// No action for commit, we want to leave the new config alone.
@@ -72,7 +130,7 @@ func configCheckpointer(r *git.Repo) (commit, rollback func(chan<- bool)) {
 		}
 		r.ReloadConfig()
 	}
-	return commit, rollback
+	return commit, rollback, nil
 }
 
 // Make commit and rollback functions for a specific repo where we will
@@ -89,8 +147,18 @@ func branchCheckpointer(r *git.Repo) (commit, rollback func(chan<- bool)) {
 	// On rollback, force all the branches back to where we were.
 	rollback = func(c chan<- bool) {
 		res := true
+		current := ""
+		if ref, err := r.CurrentRef(); err == nil {
+			current = ref.Name()
+		}
 		for name, sha := range refs {
-			cmd, _, _ := r.Git("branch", "-f", name, sha)
+			var cmd *exec.Cmd
+			if name == current {
+				// git branch -f refuses to move the checked out branch.
+				cmd, _, _ = r.Git("reset", "-q", "--hard", sha)
+			} else {
+				cmd, _, _ = r.Git("branch", "-f", name, sha)
+			}
 			res = res && (cmd.Run() == nil)
 		}
 		c <- res
@@ -106,23 +174,27 @@ type ResultTokens []*ResultToken
 type resultChan chan *ResultToken
 
 // The function signature that a mapper function must have.
+// context.Context will be cancelled if the operation is interrupted or
+//   times out, and mappers should stop what they are doing when it is.
 // string should be a unique name that should be derived from the name of a
 //   repository in some way.
 // *git.Repo is a pointer to a git repository structure.
 // resultChan is the channel that the mapper should put its ResultToken on.
 // repoMapper must populate the commit and rollback functions in the ResultToken,
 // although they can be functions that do nothing.
-type repoMapper func(string, *git.Repo, resultChan)
+type repoMapper func(context.Context, string, *git.Repo, resultChan)
 
 // The function signature that a reducer must have. It should loop over
 // the values it gets from resultChan, evaluate overall success or failure,
 // and return the overall success or failure along with an array of all the results.
-type repoReducer func(resultChan) (bool, ResultTokens)
+// repoMapReduce guarantees that exactly one value will arrive on resultChan
+// for each repository, even if the operation is cancelled.
+type repoReducer func(context.Context, resultChan) (bool, ResultTokens)
 
 // Make a basic reducer that can be used if more complicated processing
 // during a reduce is not needed.
 func makeBasicReducer(items int) repoReducer {
-	return func(vals resultChan) (ok bool, res ResultTokens) {
+	return func(ctx context.Context, vals resultChan) (ok bool, res ResultTokens) {
 		res = make(ResultTokens, items, items)
 		ok = true
 		for i := range res {
@@ -134,16 +206,103 @@ func makeBasicReducer(items int) repoReducer {
 	}
 }
 
+// Figure out how many mappers repoMapReduce should run at once.
+func (w *Workspace) jobs() int {
+	if w.Jobs > 0 {
+		return w.Jobs
+	}
+	if val, found := w.Repo.Get("crowbar.jobs"); found {
+		if j, err := strconv.Atoi(val); err == nil && j > 0 {
+			return j
+		}
+		log.Printf("Ignoring invalid crowbar.jobs setting %q\n", val)
+	}
+	return runtime.NumCPU()
+}
+
+// Figure out how long each mapper in repoMapReduce is allowed to run.
+func (w *Workspace) timeout() time.Duration {
+	if w.Timeout > 0 {
+		return w.Timeout
+	}
+	if val, found := w.Repo.Get("crowbar.timeout"); found {
+		if t, err := time.ParseDuration(val); err == nil && t > 0 {
+			return t
+		}
+		log.Printf("Ignoring invalid crowbar.timeout setting %q\n", val)
+	}
+	return 0
+}
+
+// Make a context that will be cancelled when the user hits Ctrl-C.
+// The returned function must be called when the operation is finished
+// to stop listening for interrupts.
+func interruptibleContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			log.Println("Interrupted, stopping outstanding operations.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupts)
+		cancel()
+	}
+}
+
 // Perform operations in parallel across the repositories and collect the results.
+// At most jobs() mappers will run at any one time, and the rest of the
+// repositories are queued up and handed out as mappers finish.
+// Each mapper is cancelled if it runs longer than timeout(), and
+// hitting Ctrl-C cancels all running mappers and skips the queued ones.
 // If all the results are OK, then the commit function of each ResultToken is called,
 // otherwise the rollback function of each ResultToken is called.
-func repoMapReduce(repos RepoMap, mapper repoMapper, reducer repoReducer) (ok bool, res ResultTokens) {
+// If any of the commit or rollback functions fail, ErrCommitFailed is returned.
+func (w *Workspace) repoMapReduce(repos RepoMap, mapper repoMapper, reducer repoReducer) (ok bool, res ResultTokens, err error) {
+	ctx, stop := interruptibleContext()
+	defer stop()
 	results := make(resultChan)
 	defer close(results)
-	for name, repo := range repos {
-		go mapper(name, repo, results)
+	queue := make(chan string, len(repos))
+	for name := range repos {
+		queue <- name
+	}
+	close(queue)
+	workers := w.jobs()
+	if workers > len(repos) {
+		workers = len(repos)
+	}
+	limit := w.timeout()
+	worker := func() {
+		for name := range queue {
+			if err := ctx.Err(); err != nil {
+				results <- makeCancelledToken(name, err)
+				continue
+			}
+			var mctx context.Context
+			var cancel context.CancelFunc
+			if limit > 0 {
+				mctx, cancel = context.WithTimeout(ctx, limit)
+			} else {
+				mctx, cancel = context.WithCancel(ctx)
+			}
+			mapper(mctx, name, repos[name], results)
+			cancel()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	ok, res = reducer(ctx, results)
+	if ctx.Err() != nil {
+		log.Println("Operation cancelled, rolling back all changes.")
+		ok = false
 	}
-	ok, res = reducer(results)
 	crChan := make(chan bool)
 	defer close(crChan)
 	crOK := true
@@ -164,8 +323,7 @@ func repoMapReduce(repos RepoMap, mapper repoMapper, reducer repoReducer) (ok bo
 		} else {
 			cr = "rollback"
 		}
-		log.Printf("Please email this traceback to crowbar@lists.us.dell.com\n")
-		log.Panicf("Unable to %s all repoMapReduce operations!\n", cr)
+		return ok, res, fmt.Errorf("%w: %s failed", ErrCommitFailed, cr)
 	}
-	return ok, res
+	return ok, res, nil
 }
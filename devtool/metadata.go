@@ -0,0 +1,121 @@
+package devtool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metadataBackend is implemented by the Metadata types that Open knows
+// how to probe for, and that ConvertMetadata can migrate between.
+type metadataBackend interface {
+	Metadata
+	// The name of the backend, as passed to dev metadata convert.
+	backendName() string
+	// Write out all the releases and builds in src using this backend,
+	// and stage the changes in the main Crowbar repository.
+	// This must not commit anything.
+	importFrom(src Metadata) error
+	// Remove the storage for this backend, and stage the removal
+	// in the main Crowbar repository.  This must not commit anything.
+	remove() error
+}
+
+// The metadata backends we know about, in the order Open probes for them.
+var metadataBackends = []func(*Workspace) metadataBackend{
+	func(w *Workspace) metadataBackend { return newRefMetadata(w) },
+	func(w *Workspace) metadataBackend { return newYAMLMetadata(w) },
+	func(w *Workspace) metadataBackend { return newFlatMetadata(w) },
+}
+
+// Find the first metadata backend that can handle this workspace.
+func (w *Workspace) probeMetadata() error {
+	problems := make([]string, 0, len(metadataBackends))
+	for _, maker := range metadataBackends {
+		meta := maker(w)
+		err := meta.Probe()
+		if err == nil {
+			w.Meta = meta
+			return nil
+		}
+		problems = append(problems, err.Error())
+	}
+	return fmt.Errorf("%w: %s", ErrBadMetadata, strings.Join(problems, " "))
+}
+
+// MetadataBackend returns the name of the backend that the release
+// metadata is stored with.
+func (w *Workspace) MetadataBackend() string {
+	if meta, ok := w.Meta.(metadataBackend); ok {
+		return meta.backendName()
+	}
+	return "unknown"
+}
+
+// ConvertMetadata migrates the release metadata to a different backend,
+// and commits the result in the main Crowbar repository.
+func (w *Workspace) ConvertMetadata(to string) error {
+	current, ok := w.Meta.(metadataBackend)
+	if !ok {
+		return fmt.Errorf("Current metadata cannot be converted")
+	}
+	var target metadataBackend
+	names := make([]string, 0, len(metadataBackends))
+	for _, maker := range metadataBackends {
+		meta := maker(w)
+		names = append(names, meta.backendName())
+		if meta.backendName() == to {
+			target = meta
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("Unknown metadata backend %s, must be one of %s", to, strings.Join(names, ", "))
+	}
+	if current.backendName() == to {
+		return fmt.Errorf("Metadata is already stored as %s", to)
+	}
+	// Neither backend can undo changes to the metadata ref, and those
+	// happen right away rather than with the commit, so put the ref back
+	// where it was if anything fails.
+	restoreRef := saveMetadataRef(w.Repo)
+	fail := func(err error) error {
+		restoreRef()
+		current.Probe()
+		return err
+	}
+	if err := target.importFrom(current); err != nil {
+		return fail(err)
+	}
+	if err := current.remove(); err != nil {
+		return fail(err)
+	}
+	cmd, _, _ := w.Repo.Git("commit", "-m",
+		fmt.Sprintf("Converted release metadata from %s to %s", current.backendName(), to))
+	if err := cmd.Run(); err != nil {
+		return fail(fmt.Errorf("Could not commit converted metadata"))
+	}
+	if err := target.Probe(); err != nil {
+		return err
+	}
+	w.Meta = target
+	return nil
+}
+
+// Recreate the change-image and extra symlinks at the top of the main
+// Crowbar repository so that they point into dir.  If dir does not
+// have one of them, the symlink is removed.
+func (w *Workspace) linkBuildExtras(dir string) error {
+	for _, link := range []string{"change-image", "extra"} {
+		linkPath := filepath.Join(w.Repo.WorkDir, link)
+		target := filepath.Join(dir, link)
+		os.Remove(linkPath)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		if err := os.Symlink(target, linkPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
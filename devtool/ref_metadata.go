@@ -0,0 +1,195 @@
+package devtool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/VictorLowther/go-git/git"
+	"os/exec"
+	"strings"
+)
+
+// The ref that the ref metadata backend keeps releases.yml on.
+const metadataRef = "refs/crowbar/metadata"
+
+// yamlRefStore keeps releases.yml in the tree of a dedicated ref in the
+// main Crowbar repository instead of in the working tree.  This means that
+// the release definitions do not change when the checked out branch does,
+// and that they are versioned independently of the code.
+//
+// Everything is done with git plumbing, so the index and working tree of
+// the main Crowbar repository are never touched, and every store is a
+// commit on the ref.
+type yamlRefStore struct {
+	ws  *Workspace
+	ref string
+	// The commit the ref pointed at when we loaded it, or "" if it
+	// did not exist.  We refuse to update the ref if it has moved since.
+	sha string
+}
+
+// Make a new YAMLMetadata for a workspace that keeps releases.yml on
+// refs/crowbar/metadata.  It will not know about any releases until it is probed.
+func newRefMetadata(w *Workspace) *YAMLMetadata {
+	return &YAMLMetadata{
+		ws:       w,
+		store:    &yamlRefStore{ws: w, ref: metadataRef},
+		releases: make(map[string]*YAMLRelease),
+	}
+}
+
+// Where we keep the copy of the metadata ref fetched from a remote.
+func remoteMetadataRef(remote string) string {
+	return "refs/remotes/" + remote + "/crowbar-metadata"
+}
+
+// Fetch the metadata ref from a remote into remoteMetadataRef, and
+// fast-forward our copy of it to match if we can.  If we have metadata
+// commits that the remote does not, ours is left alone so that they can
+// be pushed, and if both sides have commits the other does not,
+// ErrMetadataDiverged is returned.  Remotes that do not have the ref
+// are skipped.
+func fetchMetadataRef(ctx context.Context, repo *git.Repo, remote string) error {
+	cmd, _, _ := repo.Git("ls-remote", "--exit-code", remote, metadataRef)
+	if err := runCmd(ctx, cmd); err != nil {
+		// ls-remote exits with 2 when the remote does not have the ref.
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return nil
+		}
+		return err
+	}
+	tracking := remoteMetadataRef(remote)
+	cmd, _, _ = repo.Git("fetch", remote, "+"+metadataRef+":"+tracking)
+	if err := runCmd(ctx, cmd); err != nil {
+		return err
+	}
+	cmd, theirs, _ := repo.Git("rev-parse", "-q", "--verify", tracking)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Cannot find %s after fetching it", tracking)
+	}
+	cmd, ours, _ := repo.Git("rev-parse", "-q", "--verify", metadataRef)
+	if cmd.Run() != nil {
+		// We have no metadata of our own yet.
+		cmd, _, _ = repo.Git("update-ref", metadataRef, strings.TrimSpace(theirs.String()))
+		return cmd.Run()
+	}
+	oursSHA, theirsSHA := strings.TrimSpace(ours.String()), strings.TrimSpace(theirs.String())
+	if oursSHA == theirsSHA {
+		return nil
+	}
+	cmd, _, _ = repo.Git("merge-base", "--is-ancestor", oursSHA, theirsSHA)
+	if cmd.Run() == nil {
+		cmd, _, _ = repo.Git("update-ref", metadataRef, theirsSHA, oursSHA)
+		return cmd.Run()
+	}
+	cmd, _, _ = repo.Git("merge-base", "--is-ancestor", theirsSHA, oursSHA)
+	if cmd.Run() == nil {
+		// We are ahead, and dev push will take care of it.
+		return nil
+	}
+	return fmt.Errorf("%w: %s and %s both have changes", ErrMetadataDiverged, metadataRef, tracking)
+}
+
+// Remember where the metadata ref points, and return a function that
+// puts it back there, or deletes it if it did not exist.
+func saveMetadataRef(repo *git.Repo) func() {
+	cmd, out, _ := repo.Git("rev-parse", "-q", "--verify", metadataRef)
+	if cmd.Run() != nil {
+		return func() {
+			cmd, _, _ := repo.Git("update-ref", "-d", metadataRef)
+			cmd.Run()
+		}
+	}
+	sha := strings.TrimSpace(out.String())
+	return func() {
+		cmd, _, _ := repo.Git("update-ref", metadataRef, sha)
+		cmd.Run()
+	}
+}
+
+// Whether our metadata ref has something that remote does not.
+func metadataNeedsPush(repo *git.Repo, remote string) bool {
+	cmd, local, _ := repo.Git("rev-parse", "-q", "--verify", metadataRef)
+	if cmd.Run() != nil {
+		return false
+	}
+	cmd, theirs, _ := repo.Git("ls-remote", remote, metadataRef)
+	if cmd.Run() != nil {
+		return true
+	}
+	fields := strings.Fields(theirs.String())
+	return len(fields) == 0 || fields[0] != strings.TrimSpace(local.String())
+}
+
+func (s *yamlRefStore) String() string {
+	return s.ref + ":releases.yml"
+}
+
+func (s *yamlRefStore) backendName() string {
+	return "ref"
+}
+
+// Run a git plumbing command in the main Crowbar repository, feeding it
+// stdin if it is not nil, and return its trimmed output.
+func (s *yamlRefStore) plumb(stdin []byte, args ...string) (string, error) {
+	cmd, out, errOut := s.ws.Repo.Git(args[0], args[1:]...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(errOut.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func (s *yamlRefStore) load() ([]byte, error) {
+	sha, err := s.plumb(nil, "rev-parse", "-q", "--verify", s.ref+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find %s, metadata cannot be on a ref.", s.ref)
+	}
+	cmd, out, _ := s.ws.Repo.Git("cat-file", "blob", sha+":releases.yml")
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s does not have a releases.yml", ErrBadMetadata, s.ref)
+	}
+	s.sha = sha
+	return out.Bytes(), nil
+}
+
+// Write buf as releases.yml in a new commit on the ref.
+// Since the ref is not part of the working tree, there is nothing
+// to stage, and commit is ignored.
+func (s *yamlRefStore) store(buf []byte, commitmsg string, commit bool) error {
+	blob, err := s.plumb(buf, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	tree, err := s.plumb([]byte(fmt.Sprintf("100644 blob %s\treleases.yml\n", blob)), "mktree")
+	if err != nil {
+		return err
+	}
+	args := []string{"commit-tree", tree, "-m", commitmsg}
+	if s.sha != "" {
+		args = append(args, "-p", s.sha)
+	}
+	sha, err := s.plumb(nil, args...)
+	if err != nil {
+		return err
+	}
+	if _, err = s.plumb(nil, "update-ref", "-m", commitmsg, s.ref, sha, s.sha); err != nil {
+		return fmt.Errorf("Could not update %s, it may have been changed by someone else: %v", s.ref, err)
+	}
+	s.sha = sha
+	return nil
+}
+
+// Delete the ref, as long as nobody else has changed it since we loaded it.
+func (s *yamlRefStore) remove() error {
+	if s.sha == "" {
+		return nil
+	}
+	if _, err := s.plumb(nil, "update-ref", "-d", s.ref, s.sha); err != nil {
+		return fmt.Errorf("Could not remove %s: %v", s.ref, err)
+	}
+	s.sha = ""
+	return nil
+}
@@ -0,0 +1,91 @@
+package devtool
+
+import (
+	"context"
+	"errors"
+	"github.com/VictorLowther/go-git/git"
+	"os"
+	"testing"
+)
+
+// Make a commit on the metadata ref in dir on top of parent, or
+// with no parent if parent is empty, and return its SHA.
+func testMetadataCommit(t *testing.T, dir, parent, msg string) string {
+	t.Helper()
+	tree := testGit(t, dir, "mktree")
+	args := []string{"commit-tree", tree, "-m", msg}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	sha := testGit(t, dir, args...)
+	testGit(t, dir, "update-ref", metadataRef, sha)
+	return sha
+}
+
+func TestFetchMetadataRef(t *testing.T) {
+	tests := []struct {
+		name string
+		// Set up the local metadata ref given the shared base commit,
+		// and return what it should point at after the fetch.
+		local    func(t *testing.T, dir, base, theirs string) string
+		diverged bool
+	}{
+		{
+			name: "no local metadata",
+			local: func(t *testing.T, dir, base, theirs string) string {
+				testGit(t, dir, "update-ref", "-d", metadataRef)
+				return theirs
+			},
+		},
+		{
+			name: "behind",
+			local: func(t *testing.T, dir, base, theirs string) string {
+				return theirs
+			},
+		},
+		{
+			name: "ahead",
+			local: func(t *testing.T, dir, base, theirs string) string {
+				testGit(t, dir, "update-ref", metadataRef, theirs)
+				return testMetadataCommit(t, dir, theirs, "Local change")
+			},
+		},
+		{
+			name: "diverged",
+			local: func(t *testing.T, dir, base, theirs string) string {
+				return testMetadataCommit(t, dir, base, "Local change")
+			},
+			diverged: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remoteDir := testSyncRepo(t, false)
+			defer os.RemoveAll(remoteDir)
+			localDir := testSyncRepo(t, false)
+			defer os.RemoveAll(localDir)
+			base := testMetadataCommit(t, remoteDir, "", "Base")
+			theirs := testMetadataCommit(t, remoteDir, base, "Remote change")
+			testGit(t, localDir, "remote", "add", "origin", remoteDir)
+			testGit(t, localDir, "fetch", "-q", "origin", metadataRef+":"+metadataRef)
+			testGit(t, localDir, "update-ref", metadataRef, base)
+			expected := test.local(t, localDir, base, theirs)
+			repo, err := git.Open(localDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fetchMetadataRef(context.Background(), repo, "origin")
+			if test.diverged != errors.Is(err, ErrMetadataDiverged) {
+				t.Fatalf("Expected divergence to be %v, got %v", test.diverged, err)
+			} else if !test.diverged && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sha := testGit(t, localDir, "rev-parse", metadataRef); sha != expected {
+				t.Errorf("Expected %s to be %s, got %s", metadataRef, expected, sha)
+			}
+			if sha := testGit(t, localDir, "rev-parse", remoteMetadataRef("origin")); sha != theirs {
+				t.Errorf("Expected %s to be %s, got %s", remoteMetadataRef("origin"), theirs, sha)
+			}
+		})
+	}
+}
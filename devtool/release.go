@@ -1,38 +1,46 @@
 package devtool
 
 import (
+	"context"
 	"fmt"
+	buildutils "github.com/VictorLowther/crowbar-devtool/build"
 	"github.com/VictorLowther/go-git/git"
-	"log"
+	"regexp"
 	"sort"
 	"strings"
 )
 
 // Get all the releases we know about.
-func Releases() ReleaseMap {
-	return Meta.Releases()
+func (w *Workspace) Releases() ReleaseMap {
+	return w.Meta.Releases()
 }
 
 // Get a specific release.
-func GetRelease(release string) Release {
-	rels := Releases()
+func (w *Workspace) GetRelease(release string) (Release, error) {
+	rels := w.Releases()
 	res, ok := rels[release]
 	if !ok {
-		log.Fatalf("%s is not a release!\n", release)
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchRelease, release)
 	}
-	return res
+	return res, nil
 }
 
-func SplitRelease(from Release, to string) (res Release, err error) {
-	releases := Releases()
+func (w *Workspace) SplitRelease(from Release, to string) (res Release, err error) {
+	releases := w.Releases()
 	if _, found := releases[to]; found {
 		return nil, fmt.Errorf("Release %s already exists, cannot create it!\n", to)
 	}
-	newBranch := ReleaseBranch(to)
+	newBranch, err := ReleaseBranch(to)
+	if err != nil {
+		return nil, err
+	}
 	barclamps := from.Barclamps()
 	bases := make([]*git.Ref, 0, len(barclamps))
 	// Get all the refs we need to fork, or die.
 	for _, barclamp := range barclamps {
+		if barclamp.Repo == nil {
+			return nil, fmt.Errorf("%w: barclamp %s is not cloned", ErrMissingBarclamps, barclamp.Name)
+		}
 		base, err := barclamp.Repo.Ref(barclamp.Branch)
 		if err != nil {
 			return nil, fmt.Errorf("Base ref %s for barclamp %s in source release %s does not exist!", from.Name(), barclamp.Name, barclamp.Branch)
@@ -54,36 +62,34 @@ func SplitRelease(from Release, to string) (res Release, err error) {
 }
 
 // Given the name of a release, return what its git branch should be.
-func ReleaseBranch(release string) string {
+func ReleaseBranch(release string) (string, error) {
 	if release == "development" {
-		return "master"
+		return "master", nil
 	}
 	parts := strings.Split(release, "/")
 	switch {
 	case len(parts) == 1:
-		return "release/" + release + "/master"
+		return "release/" + release + "/master", nil
 	case len(parts) == 2 && parts[0] == "feature":
-		return "feature/" + parts[1] + "/master"
+		return "feature/" + parts[1] + "/master", nil
 	case len(parts) == 2 && parts[0] == "local":
-		return "local/" + parts[1] + "/master"
-	default:
-		log.Fatalf("%s is not a valid release name!\n", release)
+		return "local/" + parts[1] + "/master", nil
 	}
-	return ""
+	return "", fmt.Errorf("%w: %s", ErrInvalidReleaseName, release)
 }
 
 // Get the current release that this repo set is working in.
-func CurrentRelease() Release {
-	res, found := Repo.Get("crowbar.release")
-	if found {
-		return GetRelease(res)
+func (w *Workspace) CurrentRelease() (Release, error) {
+	res, found := w.Repo.Get("crowbar.release")
+	if !found {
+		return nil, ErrNoCurrentBuild
 	}
-	return nil
+	return w.GetRelease(res)
 }
 
 // Remove a release.  Has no warnings or sanity checking.
-func RemoveRelease(rel Release) error {
-	if rel.Name() == CurrentRelease().Name() {
+func (w *Workspace) RemoveRelease(rel Release) error {
+	if current, err := w.CurrentRelease(); err == nil && rel.Name() == current.Name() {
 		return fmt.Errorf("Cannot remove current release %s", rel.Name())
 	}
 	for _, barclamp := range rel.Barclamps() {
@@ -102,11 +108,24 @@ func ShowRelease(rel Release) {
 	if parent != nil {
 		fmt.Printf("Parent: %s\n", parent.Name())
 	}
-	fmt.Printf("Default Branch: %s\n", ReleaseBranch(rel.Name()))
+	if branch, err := ReleaseBranch(rel.Name()); err == nil {
+		fmt.Printf("Default Branch: %s\n", branch)
+	}
 	fmt.Printf("Builds:\n")
 	for name := range rel.Builds() {
 		fmt.Printf("\t%s\n", name)
 	}
+	if tags := rel.Tags(); len(tags) > 0 {
+		names := make([]string, 0, len(tags))
+		for name := range tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("Tags:\n")
+		for _, name := range names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
 }
 
 type cherryRefs struct {
@@ -114,26 +133,54 @@ type cherryRefs struct {
 	baseName, workingName string
 }
 
-func showChanges(refs map[string]*cherryRefs) {
-	names := make([]string,0,10)
-	for name := range refs{
-		names = append(names,name)
+// ChangeSet holds the commits in one branch of a repository that are
+// not present in another branch of that repository.
+type ChangeSet struct {
+	Repo    string   `json:"repo"`
+	Working string   `json:"working"`
+	Base    string   `json:"base"`
+	Changes []string `json:"changes"`
+}
+
+// Find the changes for each set of refs, sorted by repository name.
+// Repositories without any changes are skipped.
+func findChanges(refs map[string]*cherryRefs) (res []*ChangeSet) {
+	names := make([]string, 0, 10)
+	for name := range refs {
+		names = append(names, name)
 	}
 	sort.Strings(names)
-	noChanges := true
+	res = make([]*ChangeSet, 0, len(names))
 	for _, name := range names {
 		r := refs[name]
 		changes, err := r.working.CherryLog(r.base)
 		if err != nil || (len(changes) == 0) {
 			continue
 		}
-		noChanges = false
-		fmt.Printf("\n%s: changes in %s compared to %s\n", name, r.workingName, r.baseName)
+		set := &ChangeSet{
+			Repo:    name,
+			Working: r.workingName,
+			Base:    r.baseName,
+			Changes: make([]string, 0, len(changes)),
+		}
 		for _, change := range changes {
+			set.Changes = append(set.Changes, fmt.Sprint(change))
+		}
+		res = append(res, set)
+	}
+	return res
+}
+
+// ShowChanges prints the changes found by CrossReleaseChanges,
+// LocalChanges, or RemoteChanges.
+func ShowChanges(sets []*ChangeSet) {
+	for _, set := range sets {
+		fmt.Printf("\n%s: changes in %s compared to %s\n", set.Repo, set.Working, set.Base)
+		for _, change := range set.Changes {
 			fmt.Printf("%s\n", change)
 		}
 	}
-	if noChanges {
+	if len(sets) == 0 {
 		fmt.Println("No unmerged changes")
 	}
 }
@@ -160,9 +207,73 @@ func findLocalChangeRefs(rel Release) (refs map[string]*cherryRefs) {
 	return
 }
 
+// Find every barclamp branch that some build of a release uses, sorted
+// by barclamp and branch.  Unlike Release.Barclamps, a barclamp that uses
+// different branches in different builds is included once for each.
+func releaseBranches(rel Release) []*Barclamp {
+	found := make(map[string]*Barclamp)
+	for _, build := range rel.Builds() {
+		for name, bc := range build.Barclamps() {
+			found[name+" "+bc.Branch] = &Barclamp{Name: name, Branch: bc.Branch, Repo: bc.Repo}
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make([]*Barclamp, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, found[key])
+	}
+	return res
+}
+
+// Find the local commits on a branch of repo that are not on remote, as
+// a ChangeSet for the repository called name.  If remote does not have
+// the branch at all, there is nothing on remote to compare it against, so
+// its changes are the local commits that are not on any branch of remote,
+// and the Base of the ChangeSet is empty.  Returns nil if there is nothing
+// to push.
+func unpushedChanges(name string, repo *git.Repo, branch, remote string) *ChangeSet {
+	if repo == nil || !repo.HasRemote(remote) {
+		return nil
+	}
+	localRef, err := repo.Ref(branch)
+	if err != nil {
+		return nil
+	}
+	set := &ChangeSet{
+		Repo:    name,
+		Working: branch,
+		Changes: make([]string, 0),
+	}
+	if remoteRef, err := repo.Ref(remote + "/" + branch); err == nil {
+		changes, err := localRef.CherryLog(remoteRef)
+		if err != nil || len(changes) == 0 {
+			return nil
+		}
+		set.Base = remote
+		for _, change := range changes {
+			set.Changes = append(set.Changes, fmt.Sprint(change))
+		}
+		return set
+	}
+	cmd, out, _ := repo.Git("log", "--reverse", "--format=+ %H", branch, "--not", "--remotes="+remote)
+	if cmd.Run() != nil {
+		return nil
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line != "" {
+			set.Changes = append(set.Changes, line)
+		}
+	}
+	return set
+}
+
 // CrossReleaseChanges will find all commits in the target release that
 // are not present in the base release. It uses the same logic that git-cherry uses.
-func CrossReleaseChanges(target, base Release) {
+func CrossReleaseChanges(target, base Release) []*ChangeSet {
 	baseBarclamps,targetBarclamps := base.Barclamps(), target.Barclamps()
 	commonNames := make([]string,0,10)
 	for name := range baseBarclamps {
@@ -189,23 +300,287 @@ func CrossReleaseChanges(target, base Release) {
 			workingName: target.Name(),
 		}
 	}
-	showChanges(refs)
+	return findChanges(refs)
 }
 
 // LocalChanges shows any local changes to a release that have not
 // been comitted upstream.  It uses the same logic that git-cherry uses.
-func LocalChanges(rel Release) {
-	showChanges(findLocalChangeRefs(rel))
+func LocalChanges(rel Release) []*ChangeSet {
+	return findChanges(findLocalChangeRefs(rel))
 }
 
 // RemoteChanges shows any remote changes to a release that have been
 // fetched but not merged into the local branches.
 // It uses the same logic that git-cherry uses.
-func RemoteChanges(rel Release) {
+func RemoteChanges(rel Release) []*ChangeSet {
 	refs := findLocalChangeRefs(rel)
 	for _,r := range refs {
 		r.baseName, r.workingName = r.workingName, r.baseName
 		r.base, r.working = r.working, r.base
 	}
-	showChanges(refs)
+	return findChanges(refs)
+}
+
+// VersionCheck is the result of comparing the crowbar.yml version of
+// a barclamp between two releases.
+type VersionCheck struct {
+	Barclamp      string `json:"barclamp"`
+	BaseVersion   int    `json:"base_version"`
+	TargetVersion int    `json:"target_version"`
+	// How many commits are in the target release but not in the base.
+	Changes int `json:"changes"`
+	// What is wrong, if anything.
+	Problem string `json:"problem,omitempty"`
+}
+
+// Read the version of a barclamp from the crowbar.yml on its branch.
+func barclampVersion(bc *Barclamp) (int, error) {
+	data, err := bc.ReadFile("crowbar.yml")
+	if err != nil {
+		return 0, err
+	}
+	src := &buildutils.Source{Path: fmt.Sprintf("crowbar.yml on branch %s of %s", bc.Branch, bc.Name), Data: data}
+	meta, err := src.Parse()
+	if err != nil {
+		return 0, err
+	}
+	return meta.Barclamp.Version, nil
+}
+
+// CheckVersions compares the versions in the crowbar.yml files of the
+// barclamps that are in both releases.  A barclamp has a problem if it
+// has changes in target that are not in base (according to
+// CrossReleaseChanges) but its version did not go up, or if its
+// version went backwards, or if its version cannot be read from either
+// release.  Results are sorted by barclamp name.
+func CheckVersions(target, base Release) []*VersionCheck {
+	changes := make(map[string]int)
+	for _, set := range CrossReleaseChanges(target, base) {
+		changes[strings.TrimPrefix(set.Repo, "barclamp-")] = len(set.Changes)
+	}
+	baseBarclamps, targetBarclamps := base.Barclamps(), target.Barclamps()
+	names := make([]string, 0, len(targetBarclamps))
+	for name := range targetBarclamps {
+		if _, ok := baseBarclamps[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := make([]*VersionCheck, 0, len(names))
+	for _, name := range names {
+		check := &VersionCheck{Barclamp: name, Changes: changes[name]}
+		var baseErr, targetErr error
+		check.BaseVersion, baseErr = barclampVersion(baseBarclamps[name])
+		check.TargetVersion, targetErr = barclampVersion(targetBarclamps[name])
+		switch {
+		case baseErr != nil:
+			check.Problem = fmt.Sprintf("cannot read version in %s: %v", base.Name(), baseErr)
+		case targetErr != nil:
+			check.Problem = fmt.Sprintf("cannot read version in %s: %v", target.Name(), targetErr)
+		case check.TargetVersion < check.BaseVersion:
+			check.Problem = fmt.Sprintf("version went backwards from %d in %s to %d in %s",
+				check.BaseVersion, base.Name(), check.TargetVersion, target.Name())
+		case check.Changes > 0 && check.TargetVersion == check.BaseVersion:
+			check.Problem = fmt.Sprintf("%d changes in %s, but version is still %d",
+				check.Changes, target.Name(), check.TargetVersion)
+		}
+		res = append(res, check)
+	}
+	return res
+}
+
+// Make a mapper for operations that check out other branches and
+// change them.  The branches are rolled back with branchCheckpointer if
+// the operation fails anywhere, and whatever was checked out beforehand
+// is checked out again once op is done.  op returns the Results for
+// the ResultToken.
+func branchMapper(op func(context.Context, string, *git.Repo) (interface{}, error)) repoMapper {
+	return func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
+		tok := makeResultToken()
+		tok.commit, tok.rollback = branchCheckpointer(repo)
+		tok.Name, tok.OK = name, true
+		head, err := headOf(repo)
+		if err != nil {
+			tok.OK, tok.Results = false, err
+			res <- tok
+			return
+		}
+		if tok.Results, err = op(ctx, name, repo); err != nil {
+			tok.OK, tok.Results = false, err
+		}
+		if cmd, _, _ := repo.Git("checkout", "-q", head); cmd.Run() != nil && tok.OK {
+			tok.OK, tok.Results = false, fmt.Errorf("Cannot check out %s again", head)
+		}
+		res <- tok
+	}
+}
+
+// Merge from into to in a repository.  to is checked out to do the
+// merge, and it is up to the caller to check out whatever should be
+// checked out afterwards.  If the merge conflicts, it is aborted.
+func mergeBranch(ctx context.Context, repo *git.Repo, from, to, msg string) error {
+	cmd, _, stderr := repo.Git("checkout", "-q", to)
+	if err := runCmd(ctx, cmd); err != nil {
+		return fmt.Errorf("Cannot check out %s: %s", to, strings.TrimSpace(stderr.String()))
+	}
+	cmd, _, stderr = repo.Git("merge", "--no-edit", "-m", msg, from)
+	if err := runCmd(ctx, cmd); err == nil {
+		return nil
+	}
+	cmd, out, _ := repo.Git("diff", "--name-only", "--diff-filter=U")
+	cmd.Run()
+	conflicts := strings.Fields(out.String())
+	cmd, _, _ = repo.Git("merge", "--abort")
+	cmd.Run()
+	if len(conflicts) == 0 {
+		return fmt.Errorf("Merging %s into %s failed: %s", from, to, strings.TrimSpace(stderr.String()))
+	}
+	return fmt.Errorf("%w: merging %s into %s: %s", ErrMergeConflict, from, to, strings.Join(conflicts, ", "))
+}
+
+// MergeUp merges the branches of release from into the branches of each
+// release in to, for every barclamp that has changes in from that are
+// not in the other release (according to CrossReleaseChanges).
+// All the repositories must be clean.  Either every merge succeeds, or
+// they are all rolled back.
+func (w *Workspace) MergeUp(from Release, to []Release) (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
+	type merge struct {
+		from, to, msg string
+	}
+	merges := make(map[string][]merge)
+	repos := make(RepoMap)
+	fromBarclamps := from.Barclamps()
+	for _, rel := range to {
+		toBarclamps := rel.Barclamps()
+		for _, set := range CrossReleaseChanges(from, rel) {
+			name := strings.TrimPrefix(set.Repo, "barclamp-")
+			merges[set.Repo] = append(merges[set.Repo], merge{
+				from: fromBarclamps[name].Branch,
+				to:   toBarclamps[name].Branch,
+				msg:  fmt.Sprintf("Merge release %s into %s", from.Name(), rel.Name()),
+			})
+			repos[set.Repo] = fromBarclamps[name].Repo
+		}
+	}
+	if len(repos) == 0 {
+		return true, make(ResultTokens, 0), nil
+	}
+	mapper := branchMapper(func(ctx context.Context, name string, repo *git.Repo) (interface{}, error) {
+		merged := make([]string, 0, len(merges[name]))
+		for _, m := range merges[name] {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := mergeBranch(ctx, repo, m.from, m.to, m.msg); err != nil {
+				return nil, err
+			}
+			merged = append(merged, fmt.Sprintf("Merged %s into %s", m.from, m.to))
+		}
+		return merged, nil
+	})
+	return w.journaledMapReduce("merge-up from "+from.Name(), repos, mapper, makeBasicReducer(len(repos)))
+}
+
+// Commit is a single commit in a barclamp.
+type Commit struct {
+	Barclamp string `json:"barclamp"`
+	SHA      string `json:"sha"`
+	Subject  string `json:"subject"`
+}
+
+func (c *Commit) String() string {
+	return fmt.Sprintf("%s %s %s", c.Barclamp, c.SHA[:10], c.Subject)
+}
+
+// BackportCandidates finds the commits in target that are not in base
+// (according to CrossReleaseChanges), oldest first in each barclamp.
+// If barclamp is not empty, only that barclamp is looked at, and if
+// grep is not nil, only commits whose subject matches it are returned.
+func BackportCandidates(target, base Release, barclamp string, grep *regexp.Regexp) ([]*Commit, error) {
+	targetBarclamps, baseBarclamps := target.Barclamps(), base.Barclamps()
+	res := make([]*Commit, 0)
+	for _, set := range CrossReleaseChanges(target, base) {
+		name := strings.TrimPrefix(set.Repo, "barclamp-")
+		if barclamp != "" && name != barclamp {
+			continue
+		}
+		bc := targetBarclamps[name]
+		cmd, out, stderr := bc.Repo.Git("cherry", "-v", baseBarclamps[name].Branch, bc.Branch)
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("Cannot find changes for %s: %s", name, strings.TrimSpace(stderr.String()))
+		}
+		for _, line := range strings.Split(out.String(), "\n") {
+			// Lines are "+ sha subject", and - means the change
+			// is already in base.
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) < 2 || fields[0] != "+" {
+				continue
+			}
+			commit := &Commit{Barclamp: name, SHA: fields[1]}
+			if len(fields) == 3 {
+				commit.Subject = fields[2]
+			}
+			if grep != nil && !grep.MatchString(commit.Subject) {
+				continue
+			}
+			res = append(res, commit)
+		}
+	}
+	return res, nil
+}
+
+// Cherry-pick commits onto the branch in a repository.  The branch is
+// checked out to do the picks, and if one fails it is aborted.
+func cherryPick(ctx context.Context, repo *git.Repo, branch string, commits []*Commit) ([]string, error) {
+	cmd, _, stderr := repo.Git("checkout", "-q", branch)
+	if err := runCmd(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("Cannot check out %s: %s", branch, strings.TrimSpace(stderr.String()))
+	}
+	picked := make([]string, 0, len(commits))
+	for _, commit := range commits {
+		cmd, _, stderr = repo.Git("cherry-pick", "-x", commit.SHA)
+		if err := runCmd(ctx, cmd); err != nil {
+			cmd, out, _ := repo.Git("diff", "--name-only", "--diff-filter=U")
+			cmd.Run()
+			conflicts := strings.Fields(out.String())
+			cmd, _, _ = repo.Git("cherry-pick", "--abort")
+			cmd.Run()
+			if len(conflicts) == 0 {
+				return nil, fmt.Errorf("Cherry-picking %s onto %s failed: %s", commit.SHA, branch, strings.TrimSpace(stderr.String()))
+			}
+			return nil, fmt.Errorf("%w: cherry-picking %s onto %s: %s", ErrMergeConflict, commit.SHA, branch, strings.Join(conflicts, ", "))
+		}
+		picked = append(picked, fmt.Sprintf("Picked %s onto %s", commit, branch))
+	}
+	return picked, nil
+}
+
+// Backport cherry-picks commits onto the branches that base uses for
+// their barclamps, in the order they are passed.  All the repositories
+// must be clean.  Either every pick succeeds, or they are all rolled back.
+func (w *Workspace) Backport(base Release, commits []*Commit) (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
+	baseBarclamps := base.Barclamps()
+	picks := make(map[string][]*Commit)
+	repos := make(RepoMap)
+	for _, commit := range commits {
+		bc, found := baseBarclamps[commit.Barclamp]
+		if !found || bc.Repo == nil {
+			return false, nil, fmt.Errorf("%w: %s is not in release %s", ErrMissingBarclamps, commit.Barclamp, base.Name())
+		}
+		picks["barclamp-"+bc.Name] = append(picks["barclamp-"+bc.Name], commit)
+		repos["barclamp-"+bc.Name] = bc.Repo
+	}
+	if len(repos) == 0 {
+		return true, make(ResultTokens, 0), nil
+	}
+	mapper := branchMapper(func(ctx context.Context, name string, repo *git.Repo) (interface{}, error) {
+		return cherryPick(ctx, repo, baseBarclamps[strings.TrimPrefix(name, "barclamp-")].Branch, picks[name])
+	})
+	return w.journaledMapReduce("backport to "+base.Name(), repos, mapper, makeBasicReducer(len(repos)))
 }
@@ -1,14 +1,15 @@
 package devtool
 
 import (
+	"context"
 	"fmt"
 	"github.com/VictorLowther/go-git/git"
 	"log"
 	"net/url"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 )
 
 // Something to hang methods off of for sort.Sort() to use.
@@ -30,9 +31,9 @@ func (s RemoteSlice) Swap(i, j int) {
 }
 
 // Get the Crowbar remotes, sorted by priority.
-func SortedRemotes() (res RemoteSlice) {
+func (w *Workspace) SortedRemotes() (res RemoteSlice) {
 	res = make(RemoteSlice, 0, 2)
-	for _, remote := range Remotes {
+	for _, remote := range w.Remotes {
 		res = append(res, remote)
 	}
 	sort.Sort(res)
@@ -41,16 +42,28 @@ func SortedRemotes() (res RemoteSlice) {
 
 // Recreate the tracking branches in the git repositories based on
 // their priorities.
-func UpdateTrackingBranches() (ok bool, res ResultTokens) {
-	branchMap := AllBarclampBranches()
-	remotes := SortedRemotes()
+func (w *Workspace) UpdateTrackingBranches() (ok bool, res ResultTokens, err error) {
+	branchMap := w.AllBarclampBranches()
+	remotes := w.SortedRemotes()
 	log.Println("Updating local tracking branches.")
-	mapper := func(name string, repo *git.Repo, res resultChan) {
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
 		tok := makeResultToken()
-		tok.commit, tok.rollback = configCheckpointer(repo)
 		tok.Name, tok.OK, tok.Results = name, true, nil
+		commit, rollback, err := configCheckpointer(repo)
+		if err != nil {
+			tok.OK, tok.Results = false, err
+			res <- tok
+			return
+		}
+		tok.commit, tok.rollback = commit, rollback
 		branches := branchMap[name]
+		// We change the config behind the back of repo.
+		defer repo.ReloadConfig()
 		for _, br := range branches {
+			if err := ctx.Err(); err != nil {
+				tok.OK, tok.Results = false, err
+				break
+			}
 			ref, err := repo.Ref(br)
 			// Does this branch actually exist?
 			if err != nil || !ref.IsLocal() {
@@ -73,8 +86,9 @@ func UpdateTrackingBranches() (ok bool, res ResultTokens) {
 				}
 				// There is one, and we will track it.
 				log.Printf("%s: %s will track %s\n", name, ref.Name(), remote.Name)
-				if err := ref.TrackRemote(remote.Name); err != nil {
-					log.Print(err)
+				cmd, _, stderr := repo.Git("branch", "-q", "--set-upstream-to="+remote.Name+"/"+ref.Name(), ref.Name())
+				if err := runCmd(ctx, cmd); err != nil {
+					log.Printf("%s: %s cannot track %s: %s\n", name, ref.Name(), remote.Name, strings.TrimSpace(stderr.String()))
 					tok.OK = false
 				}
 				break
@@ -82,19 +96,18 @@ func UpdateTrackingBranches() (ok bool, res ResultTokens) {
 		}
 		res <- tok
 	}
-	ok, res = repoMapReduce(Barclamps, mapper, makeBasicReducer(len(Barclamps)))
+	ok, res, err = w.journaledMapReduce("tracking branch update", w.Barclamps, mapper, makeBasicReducer(len(w.Barclamps)))
 	return
 }
 
 // Test to see if a remote name is valid.
 // Currently we only allow alpha characters, which is probably too restrictive.
-func validRemoteName(name string) bool {
+func validRemoteName(name string) error {
 	matcher := regexp.MustCompile("^[[:alpha:]]+$")
 	if !matcher.MatchString(name) {
-		log.Printf("%s is not a valid name for a remote!")
-		return false
+		return fmt.Errorf("%w: %s is not a valid name for a remote", ErrInvalidRemote, name)
 	}
-	return true
+	return nil
 }
 
 // Check to see if the remote passed to this structure is valid.
@@ -103,14 +116,13 @@ func validRemoteName(name string) bool {
 // remote.Ulrbase starting with git, http, https, or ssh.
 // remote.Name passing validRemoteName
 // remote.Priority being between 1 and 100
-func ValidateRemote(remote *Remote) bool {
+// If the remote is not valid, the returned error will wrap ErrInvalidRemote.
+func ValidateRemote(remote *Remote) error {
 	url, err := url.Parse(remote.Urlbase)
 	if err != nil {
-		log.Printf("%s is not a URL!\n", remote.Urlbase)
-		return false
+		return fmt.Errorf("%w: %s is not a URL", ErrInvalidRemote, remote.Urlbase)
 	} else if !url.IsAbs() {
-		log.Printf("%s is not an absolute URL!\n", remote.Urlbase)
-		return false
+		return fmt.Errorf("%w: %s is not an absolute URL", ErrInvalidRemote, remote.Urlbase)
 	}
 	switch url.Scheme {
 	case "git":
@@ -119,109 +131,116 @@ func ValidateRemote(remote *Remote) bool {
 		fallthrough
 	case "https":
 		if url.User != nil {
-			log.Printf("Please don't embed userinfo in your http(s) or git URL!\n")
-			log.Printf("Instead, modify your .netrc to include it for %s\n", url.Host)
-			log.Printf("Example:\n")
-			log.Printf("  machine %s login <username> password <password>\n", url.Host)
-			return false
+			return fmt.Errorf("%w: please don't embed userinfo in your http(s) or git URL.  "+
+				"Instead, modify your .netrc to include it for %s like so:\n"+
+				"  machine %s login <username> password <password>",
+				ErrInvalidRemote, url.Host, url.Host)
 		}
 	case "ssh":
 		if url.User == nil {
-			log.Printf("%s does not include an embedded username!", remote.Urlbase)
-			return false
+			return fmt.Errorf("%w: %s does not include an embedded username", ErrInvalidRemote, remote.Urlbase)
 		}
 	default:
-		log.Printf("URL scheme %s is not supported by the dev tool for now.", url.Scheme)
-		return false
+		return fmt.Errorf("%w: URL scheme %s is not supported by the dev tool for now", ErrInvalidRemote, url.Scheme)
 	}
 	if remote.Name == "" {
 		remote.Name = filepath.Base(url.Path)
 	}
-	if !validRemoteName(remote.Name) {
-		return false
+	if err := validRemoteName(remote.Name); err != nil {
+		return err
 	}
 	if remote.Priority < 1 || remote.Priority > 100 {
-		log.Printf("Priority must be a number between 1 and 100 (currently %d)!\n", remote.Priority)
-		return false
+		return fmt.Errorf("%w: priority must be a number between 1 and 100 (currently %d)", ErrInvalidRemote, remote.Priority)
 	}
-	return true
+	return nil
 }
 
-func addRemote(remote *Remote) {
-	maybeAddRemote := func(repo *git.Repo, reponame string, remote *Remote) {
+func (w *Workspace) addRemote(remote *Remote) error {
+	maybeAddRemote := func(repo *git.Repo, reponame string, remote *Remote) error {
 		if repo.HasRemote(remote.Name) {
 			log.Printf("%s already has a repo named %s.\n", reponame, remote.Name)
 			log.Printf("Will replace it.")
 			repo.ZapRemote(remote.Name)
 		}
-		err := repo.AddRemote(remote.Name, remote.Urlbase+"/"+reponame)
-		if err != nil {
-			log.Printf("Error adding %s to %s:", remote.Name, reponame)
-			log.Fatalln(err)
+		if err := repo.AddRemote(remote.Name, remote.Urlbase+"/"+reponame); err != nil {
+			return fmt.Errorf("Error adding %s to %s: %v", remote.Name, reponame, err)
 		}
+		return nil
 	}
-	for name, repo := range Barclamps {
+	for name, repo := range w.Barclamps {
 		reponame := "barclamp-" + name
-		maybeAddRemote(repo, reponame, remote)
+		if err := maybeAddRemote(repo, reponame, remote); err != nil {
+			return err
+		}
 	}
-	for name, repo := range AllOtherRepos() {
-		maybeAddRemote(repo, name, remote)
+	for name, repo := range w.AllOtherRepos() {
+		if err := maybeAddRemote(repo, name, remote); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // Add a new Crowbar remote to all of the repositories.
-func AddRemote(remote *Remote) {
-	if !ValidateRemote(remote) {
-		log.Fatalf("%s failed validation.", remote.Name)
+func (w *Workspace) AddRemote(remote *Remote) error {
+	if err := ValidateRemote(remote); err != nil {
+		return err
+	}
+	if w.Remotes[remote.Name] != nil {
+		return fmt.Errorf("%w: %s", ErrRemoteExists, remote.Name)
 	}
-	if Remotes[remote.Name] != nil {
-		log.Panicf("Already have a remote named %s\n", remote.Name)
+	w.Repo.Set("crowbar.remote."+remote.Name+".priority", fmt.Sprint(remote.Priority))
+	w.Repo.Set("crowbar.remote."+remote.Name+".urlbase", remote.Urlbase)
+	if err := w.addRemote(remote); err != nil {
+		return err
 	}
-	Repo.Set("crowbar.remote."+remote.Name+".priority", fmt.Sprint(remote.Priority))
-	Repo.Set("crowbar.remote."+remote.Name+".urlbase", remote.Urlbase)
-	addRemote(remote)
+	w.Remotes[remote.Name] = remote
+	return nil
 }
 
 // Remove an already-existing Crowbar remote to all of the repositories.
-func ZapRemote(remote *Remote) {
-	if Remotes[remote.Name] == nil {
-		log.Panicf("Remote %s already removed!\n", remote.Name)
+func (w *Workspace) ZapRemote(remote *Remote) error {
+	if w.Remotes[remote.Name] == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchRemote, remote.Name)
 	}
-	for _, repo := range AllRepos() {
+	for _, repo := range w.AllRepos() {
 		if !repo.HasRemote(remote.Name) {
-			return
+			continue
 		}
 		_ = repo.ZapRemote(remote.Name)
 	}
-	Repo.Unset("crowbar.remote." + remote.Name + ".priority")
-	Repo.Unset("crowbar.remote." + remote.Name + ".urlbase")
+	w.Repo.Unset("crowbar.remote." + remote.Name + ".priority")
+	w.Repo.Unset("crowbar.remote." + remote.Name + ".urlbase")
+	delete(w.Remotes, remote.Name)
+	return nil
 }
 
 // Rename a remote
-func RenameRemote(remote *Remote, newname string) {
-	if Remotes[newname] != nil {
-		log.Fatalf("Remote %s already exists, cannot rename %s to it.\n", newname, remote.Name)
+func (w *Workspace) RenameRemote(remote *Remote, newname string) error {
+	if w.Remotes[newname] != nil {
+		return fmt.Errorf("%w: %s, cannot rename %s to it", ErrRemoteExists, newname, remote.Name)
 	}
-	if !validRemoteName(newname) {
-		os.Exit(1)
+	if err := validRemoteName(newname); err != nil {
+		return err
 	}
-	for _, repo := range AllRepos() {
+	for _, repo := range w.AllRepos() {
 		_ = repo.RenameRemote(remote.Name, newname)
 	}
-	Repo.Unset("crowbar.remote." + remote.Name + ".priority")
-	Repo.Unset("crowbar.remote." + remote.Name + ".urlbase")
-	delete(Remotes, remote.Name)
+	w.Repo.Unset("crowbar.remote." + remote.Name + ".priority")
+	w.Repo.Unset("crowbar.remote." + remote.Name + ".urlbase")
+	delete(w.Remotes, remote.Name)
 	remote.Name = newname
-	Remotes[remote.Name] = remote
-	Repo.Set("crowbar.remote."+remote.Name+".priority", fmt.Sprint(remote.Priority))
-	Repo.Set("crowbar.remote."+remote.Name+".urlbase", remote.Urlbase)
+	w.Remotes[remote.Name] = remote
+	w.Repo.Set("crowbar.remote."+remote.Name+".priority", fmt.Sprint(remote.Priority))
+	w.Repo.Set("crowbar.remote."+remote.Name+".urlbase", remote.Urlbase)
+	return nil
 }
 
 // Synchronize remote specifications across all the repositories.
-func SyncRemotes() {
-	for reponame, repo := range AllRepos() {
+func (w *Workspace) SyncRemotes() {
+	for reponame, repo := range w.AllRepos() {
 		remotes := repo.Remotes()
-		for _, remote := range Remotes {
+		for _, remote := range w.Remotes {
 			repopath := remote.Urlbase + "/" + reponame
 			if url, found := remotes[remote.Name]; found {
 				continue
@@ -240,11 +259,15 @@ func SyncRemotes() {
 }
 
 // Set a new remote Urlbase.
-func SetRemoteURLBase(remote *Remote, newurl string) {
-	remote.Urlbase = newurl
-	if !ValidateRemote(remote) {
-		log.Fatalf("Refusing to set new URL %s for %s\n", newurl)
+func (w *Workspace) SetRemoteURLBase(remote *Remote, newurl string) error {
+	updated := *remote
+	updated.Urlbase = newurl
+	if err := ValidateRemote(&updated); err != nil {
+		return err
+	}
+	if err := w.ZapRemote(remote); err != nil {
+		return err
 	}
-	ZapRemote(remote)
-	AddRemote(remote)
+	remote.Urlbase = newurl
+	return w.AddRemote(remote)
 }
@@ -0,0 +1,330 @@
+package devtool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/VictorLowther/go-git/git"
+	"sort"
+	"strings"
+)
+
+// Snapshot records the exact commit of a set of repositories.
+// The keys are the same as the ones AllRepos uses, so the main Crowbar
+// repository is "crowbar" and barclamps are "barclamp-" + their name.
+type Snapshot map[string]string
+
+// Format a snapshot as lines of repository name and SHA, sorted by name.
+func (s Snapshot) format() []byte {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s %s\n", name, s[name])
+	}
+	return buf.Bytes()
+}
+
+// Parse a snapshot written by format.
+func parseSnapshot(buf []byte) (Snapshot, error) {
+	res := make(Snapshot)
+	lines := bufio.NewScanner(bytes.NewReader(buf))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		switch len(fields) {
+		case 0:
+		case 2:
+			res[fields[0]] = fields[1]
+		default:
+			return nil, fmt.Errorf("Malformed snapshot line %q", lines.Text())
+		}
+	}
+	return res, lines.Err()
+}
+
+// Find the SHA that a commitish resolves to in a repository.
+func resolveCommit(repo *git.Repo, commitish string) (string, error) {
+	cmd, out, _ := repo.Git("rev-parse", "-q", "--verify", commitish+"^{commit}")
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Cannot find %s in %s", commitish, repo.WorkDir)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// Make sure a tag name is usable as a git tag, and as a file name
+// in the flat metadata.
+func (w *Workspace) validTagName(tag string) error {
+	if tag == "" || strings.Contains(tag, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+	}
+	cmd, _, _ := w.Repo.Git("check-ref-format", "refs/tags/"+tag)
+	if cmd.Run() != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+	}
+	return nil
+}
+
+// FindTag finds the release that has a tag, along with the
+// snapshot that was recorded when the tag was made.
+func (w *Workspace) FindTag(tag string) (Release, Snapshot, error) {
+	for _, rel := range w.Releases() {
+		if snap, found := rel.Tags()[tag]; found {
+			return rel, snap, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrNoSuchTag, tag)
+}
+
+// TagRelease tags the tip of the branch every barclamp in a release
+// uses and records the SHAs that were tagged in the release metadata.
+// The tag is recorded first, so that the commit that gets tagged in the
+// main Crowbar repository is one that knows about the tag.  Either every
+// repository is tagged and the tag is recorded, or nothing is.
+func (w *Workspace) TagRelease(rel Release, tag string) (ok bool, res ResultTokens, err error) {
+	if err = w.validTagName(tag); err != nil {
+		return false, nil, err
+	}
+	if other, _, err := w.FindTag(tag); err == nil {
+		return false, nil, fmt.Errorf("%w: %s is already a tag of %s", ErrInvalidTag, tag, other.Name())
+	}
+	if _, err := resolveCommit(w.Repo, "refs/tags/"+tag); err == nil {
+		return false, nil, fmt.Errorf("%w: crowbar already has a tag named %s", ErrInvalidTag, tag)
+	}
+	// Rolling back the recorded tag resets the main Crowbar repository,
+	// so it had better not have anything that would be lost.
+	if clean, _ := w.Repo.IsClean(); !clean {
+		return false, nil, fmt.Errorf("%w: crowbar", ErrDirtyRepo)
+	}
+	barclamps := rel.Barclamps()
+	if err = VerifyBarclamps(barclamps); err != nil {
+		return false, nil, err
+	}
+	repos := w.AllOtherRepos()
+	snap := make(Snapshot)
+	for name, bc := range barclamps {
+		sha, err := resolveCommit(bc.Repo, bc.Branch)
+		if err != nil {
+			return false, nil, err
+		}
+		repos["barclamp-"+name] = bc.Repo
+		snap["barclamp-"+name] = sha
+	}
+	msg := fmt.Sprintf("Release %s, tagged as %s", rel.Name(), tag)
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
+		tok := makeResultToken()
+		tok.Name, tok.OK = name, true
+		target, found := snap[name]
+		if !found {
+			target = "HEAD"
+		}
+		sha, err := resolveCommit(repo, target)
+		if err != nil {
+			tok.OK, tok.Results = false, err
+			res <- tok
+			return
+		}
+		cmd, _, stderr := repo.Git("tag", "-a", "-m", msg, tag, sha)
+		if err := runCmd(ctx, cmd); err != nil {
+			tok.OK, tok.Results = false, fmt.Errorf("Cannot tag %s: %s", sha, strings.TrimSpace(stderr.String()))
+			res <- tok
+			return
+		}
+		tok.rollback = func(c chan<- bool) {
+			cmd, _, _ := repo.Git("tag", "-d", tag)
+			c <- cmd.Run() == nil
+		}
+		tok.Results = sha
+		res <- tok
+	}
+	op := fmt.Sprintf("tag %s as %s", rel.Name(), tag)
+	return w.journaled(op, nil, func() (bool, ResultTokens, error) {
+		// Recording the tag is a step of its own, so that the journal
+		// takes it back out if tagging the repositories fails.
+		ok, res, err := w.journaled(op, nil, func() (bool, ResultTokens, error) {
+			if err := rel.AddTag(tag, snap); err != nil {
+				tok := makeResultToken()
+				tok.Name, tok.OK, tok.Results = "crowbar", false, err
+				return false, ResultTokens{tok}, nil
+			}
+			return true, nil, nil
+		})
+		if err != nil || !ok {
+			return ok, res, err
+		}
+		return w.repoMapReduce(repos, mapper, makeBasicReducer(len(repos)))
+	})
+}
+
+// Check out the commits in a snapshot in every barclamp, leaving
+// HEAD detached.  Barclamps that are not in the snapshot are switched
+// to the empty branch.  The main Crowbar repository is only checked out
+// if it is in the snapshot.
+func (w *Workspace) checkoutSnapshot(op string, snap Snapshot) (ok bool, res ResultTokens, err error) {
+	if err = w.mustBeClean(); err != nil {
+		return false, nil, err
+	}
+	missing := make([]string, 0)
+	for name := range snap {
+		if name == "crowbar" {
+			continue
+		}
+		if _, found := w.Barclamps[strings.TrimPrefix(name, "barclamp-")]; !found {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return false, nil, fmt.Errorf("%w: %s", ErrMissingBarclamps, strings.Join(missing, ", "))
+	}
+	repos := w.AllBarclampRepos()
+	if _, found := snap["crowbar"]; found {
+		repos["crowbar"] = w.Repo
+	}
+	mapper := func(ctx context.Context, name string, repo *git.Repo, res resultChan) {
+		tok := makeResultToken()
+		tok.Name, tok.OK, tok.Results = name, true, nil
+		sha, found := snap[name]
+		if !found {
+			if current, err := repo.CurrentRef(); err != nil || current.Name() != "empty-branch" {
+				if err := switchToEmptyBranch(repo); err != nil {
+					tok.OK, tok.Results = false, err
+				}
+			}
+			res <- tok
+			return
+		}
+		cmd, _, stderr := repo.Git("checkout", "-q", "--detach", sha)
+		if err := runCmd(ctx, cmd); err != nil {
+			tok.OK, tok.Results = false, fmt.Errorf("Cannot check out %s: %s", sha, strings.TrimSpace(stderr.String()))
+		} else {
+			tok.Results = "Checked out " + sha
+		}
+		res <- tok
+	}
+	return w.journaledMapReduce(op, repos, mapper, makeBasicReducer(len(repos)))
+}
+
+// SwitchTag checks out the exact commits that were tagged with tag in
+// every barclamp and in the main Crowbar repository.  All the
+// repositories must be clean.
+func (w *Workspace) SwitchTag(tag string) (ok bool, res ResultTokens, err error) {
+	rel, tagged, err := w.FindTag(tag)
+	if err != nil {
+		return false, nil, err
+	}
+	// The commit that was tagged in the main Crowbar repository is
+	// made after the tag is recorded, so the tag itself is the only
+	// record of it.
+	sha, err := resolveCommit(w.Repo, "refs/tags/"+tag)
+	if err != nil {
+		return false, nil, err
+	}
+	snap := Snapshot{"crowbar": sha}
+	for name, sha := range tagged {
+		if name != "crowbar" {
+			snap[name] = sha
+		}
+	}
+	return w.checkoutSnapshot(fmt.Sprintf("switch to tag %s of %s", tag, rel.Name()), snap)
+}
+
+// LockRelease records the commit that the branch of every barclamp in
+// a release currently points at as the lock for the release.
+func (w *Workspace) LockRelease(rel Release) (Snapshot, error) {
+	barclamps := rel.Barclamps()
+	if err := VerifyBarclamps(barclamps); err != nil {
+		return nil, err
+	}
+	snap := make(Snapshot)
+	for name, bc := range barclamps {
+		sha, err := resolveCommit(bc.Repo, bc.Branch)
+		if err != nil {
+			return nil, err
+		}
+		snap["barclamp-"+name] = sha
+	}
+	if err := rel.SetLock(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// LockDrift is a barclamp whose branch is not where the release
+// lock says it should be.
+type LockDrift struct {
+	Barclamp string `json:"barclamp"`
+	// The branch the release uses, or empty if the barclamp is only in the lock.
+	Branch string `json:"branch,omitempty"`
+	// The SHA in the lock, or empty if the barclamp is not locked.
+	Locked string `json:"locked,omitempty"`
+	// The SHA the branch points at now, or empty if it cannot be found.
+	Current string `json:"current,omitempty"`
+}
+
+// CheckLock compares the lock of a release with the current tips of the
+// branches it uses, and returns every barclamp that has drifted, sorted
+// by name.
+func CheckLock(rel Release) ([]*LockDrift, error) {
+	lock := rel.Lock()
+	if lock == nil {
+		return nil, fmt.Errorf("%w: %s has not been locked", ErrNoLock, rel.Name())
+	}
+	drifts := make(map[string]*LockDrift)
+	barclamps := rel.Barclamps()
+	for name, bc := range barclamps {
+		drift := &LockDrift{Barclamp: name, Branch: bc.Branch, Locked: lock["barclamp-"+name]}
+		if bc.Repo != nil {
+			drift.Current, _ = resolveCommit(bc.Repo, bc.Branch)
+		}
+		if drift.Current != drift.Locked || drift.Current == "" {
+			drifts[name] = drift
+		}
+	}
+	for key, sha := range lock {
+		name := strings.TrimPrefix(key, "barclamp-")
+		if _, found := barclamps[name]; !found {
+			drifts[name] = &LockDrift{Barclamp: name, Locked: sha}
+		}
+	}
+	names := make([]string, 0, len(drifts))
+	for name := range drifts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*LockDrift, 0, len(names))
+	for _, name := range names {
+		res = append(res, drifts[name])
+	}
+	return res, nil
+}
+
+// SwitchLocked switches to a build like Switch does, but checks out the
+// commits in the lock of the build's release instead of the tips of the
+// branches, leaving the barclamps on detached HEADs.  Every barclamp in
+// the build must be in the lock.
+func (w *Workspace) SwitchLocked(build Build) (ok bool, res ResultTokens, err error) {
+	lock := build.Release().Lock()
+	if lock == nil {
+		return false, nil, fmt.Errorf("%w: %s has not been locked", ErrNoLock, build.Release().Name())
+	}
+	snap := make(Snapshot)
+	for name := range BarclampsInBuild(build) {
+		sha, found := lock["barclamp-"+name]
+		if !found {
+			return false, nil, fmt.Errorf("%w: %s is not in the lock for %s", ErrNoLock, name, build.Release().Name())
+		}
+		snap["barclamp-"+name] = sha
+	}
+	return w.journaled("switch to locked "+build.FullName(), w.Barclamps, func() (bool, ResultTokens, error) {
+		ok, res, err := w.checkoutSnapshot("switch to locked "+build.FullName(), snap)
+		if ok && err == nil {
+			w.setBuild(build)
+			err = build.FinalizeSwitch()
+		}
+		return ok, res, err
+	})
+}
@@ -0,0 +1,512 @@
+package devtool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+)
+
+// The on-disk format of releases.yml.
+type yamlDoc struct {
+	Releases map[string]*yamlReleaseDoc
+}
+
+// The on-disk format of a release in releases.yml.
+// Tags maps tag names to the snapshot taken when the tag was made,
+// and Lock is the snapshot made by dev release lock.
+type yamlReleaseDoc struct {
+	Parent string `yaml:"parent,omitempty"`
+	Builds map[string]*yamlBuildDoc
+	Tags   map[string]map[string]string `yaml:"tags,omitempty"`
+	Lock   map[string]string            `yaml:"lock,omitempty"`
+}
+
+// The on-disk format of a build in releases.yml.
+// Barclamps maps barclamp names to branches.
+type yamlBuildDoc struct {
+	Parent    string `yaml:"parent,omitempty"`
+	Barclamps map[string]string
+}
+
+// yamlStore is where a YAMLMetadata keeps releases.yml.
+type yamlStore interface {
+	// Where releases.yml lives, for use in messages.
+	String() string
+	// The name of the metadata backend that uses this store.
+	backendName() string
+	// Read releases.yml.
+	load() ([]byte, error)
+	// Write releases.yml.  If commit is false, the changes must only
+	// be staged in the main Crowbar repository.
+	store(buf []byte, commitmsg string, commit bool) error
+	// Remove releases.yml.  This must not commit anything
+	// in the main Crowbar repository.
+	remove() error
+}
+
+// yamlFileStore keeps releases.yml at the top of the main Crowbar repository.
+type yamlFileStore struct {
+	ws   *Workspace
+	path string
+}
+
+func (s *yamlFileStore) String() string {
+	return s.ws.RelPath(s.path)
+}
+
+func (s *yamlFileStore) backendName() string {
+	return "yaml"
+}
+
+func (s *yamlFileStore) load() ([]byte, error) {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s, metadata cannot be YAML.", s.path)
+	}
+	return buf, nil
+}
+
+func (s *yamlFileStore) store(buf []byte, commitmsg string, commit bool) error {
+	if err := ioutil.WriteFile(s.path, buf, os.FileMode(0644)); err != nil {
+		return err
+	}
+	cmd, _, _ := s.ws.Repo.Git("add", s.String())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not add %s in Git", s)
+	}
+	if !commit {
+		return nil
+	}
+	cmd, _, _ = s.ws.Repo.Git("commit", "-m", commitmsg)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not commit %s: %s", s, commitmsg)
+	}
+	return nil
+}
+
+func (s *yamlFileStore) remove() error {
+	cmd, _, _ := s.ws.Repo.Git("rm", "-q", s.String())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not remove %s from Git", s)
+	}
+	return nil
+}
+
+// Base type for representing metadata kept in a single releases.yml file.
+type YAMLMetadata struct {
+	ws       *Workspace
+	store    yamlStore
+	releases map[string]*YAMLRelease
+}
+
+// Make a new YAMLMetadata for a workspace that keeps releases.yml in
+// the working tree.  It will not know about any releases until it is probed.
+func newYAMLMetadata(w *Workspace) *YAMLMetadata {
+	return &YAMLMetadata{
+		ws:       w,
+		store:    &yamlFileStore{ws: w, path: filepath.Join(w.Repo.Path(), "releases.yml")},
+		releases: make(map[string]*YAMLRelease),
+	}
+}
+
+// How we represent a release in the YAML metadata.
+type YAMLRelease struct {
+	name, parent string
+	meta         *YAMLMetadata
+	builds       map[string]*YAMLBuild
+	tags         map[string]Snapshot
+	lock         Snapshot
+}
+
+// Fetch the name of a release
+func (r *YAMLRelease) Name() string {
+	return r.name
+}
+
+// Get a map of builds for a specific release.
+// They will be indexed in the returned BuildMap by build.Name()
+func (r *YAMLRelease) Builds() (res BuildMap) {
+	res = make(BuildMap)
+	for name, build := range r.builds {
+		res[name] = build
+	}
+	return res
+}
+
+// Find the parent release of this release.
+// If there isn't one, return nil.
+func (r *YAMLRelease) Parent() Release {
+	if parent := r.meta.releases[r.parent]; parent != nil {
+		return Release(parent)
+	}
+	return nil
+}
+
+// Zap a release.  It will reparent any child releases.
+func (r *YAMLRelease) Zap() error {
+	for _, release := range r.meta.releases {
+		if release.parent == r.name {
+			release.parent = r.parent
+		}
+	}
+	delete(r.meta.releases, r.name)
+	return r.meta.save("Removed release " + r.name)
+}
+
+func (r *YAMLRelease) Barclamps() (res BarclampMap) {
+	res = make(BarclampMap)
+	for _, build := range r.Builds() {
+		for name, bc := range build.Barclamps() {
+			res[name] = bc
+		}
+	}
+	return res
+}
+
+// Create the YAML metadata for a new release.
+// This expects to be called from Crowbar.SplitRelease()
+func (r *YAMLRelease) FinalizeSplit(name, branch string) (Release, error) {
+	rel := &YAMLRelease{
+		name:   name,
+		parent: r.name,
+		meta:   r.meta,
+		builds: make(map[string]*YAMLBuild),
+		tags:   make(map[string]Snapshot),
+	}
+	for bname, build := range r.builds {
+		nb := &YAMLBuild{
+			name:      bname,
+			parent:    build.parent,
+			release:   rel,
+			barclamps: make(BarclampMap),
+		}
+		for bcname, bc := range build.barclamps {
+			nb.barclamps[bcname] = &Barclamp{
+				Name:   bc.Name,
+				Branch: branch,
+				Repo:   bc.Repo,
+			}
+		}
+		rel.builds[bname] = nb
+	}
+	r.meta.releases[name] = rel
+	if err := r.meta.save(fmt.Sprintf("Added new release %s", name)); err != nil {
+		delete(r.meta.releases, name)
+		return nil, err
+	}
+	return Release(rel), nil
+}
+
+// Add a new build to releases.yml.
+func (r *YAMLRelease) AddBuild(name string, parent Build, barclamps BarclampMap) (Build, error) {
+	build := &YAMLBuild{
+		name:      name,
+		release:   r,
+		barclamps: make(BarclampMap),
+	}
+	if parent != nil {
+		build.parent = parent.Name()
+	}
+	for bcName, bc := range barclamps {
+		build.barclamps[bcName] = bc
+	}
+	r.builds[name] = build
+	if err := r.meta.save("Added build " + build.FullName()); err != nil {
+		delete(r.builds, name)
+		return nil, err
+	}
+	return Build(build), nil
+}
+
+// The tags of a release.
+func (r *YAMLRelease) Tags() map[string]Snapshot {
+	res := make(map[string]Snapshot)
+	for name, snap := range r.tags {
+		res[name] = snap
+	}
+	return res
+}
+
+// Add a tag to releases.yml.
+func (r *YAMLRelease) AddTag(name string, snap Snapshot) error {
+	r.tags[name] = snap
+	if err := r.meta.save(fmt.Sprintf("Tagged release %s as %s", r.name, name)); err != nil {
+		delete(r.tags, name)
+		return err
+	}
+	return nil
+}
+
+// The lock of a release.
+func (r *YAMLRelease) Lock() Snapshot {
+	return r.lock
+}
+
+// Replace the lock of a release in releases.yml.
+func (r *YAMLRelease) SetLock(snap Snapshot) error {
+	old := r.lock
+	r.lock = snap
+	if err := r.meta.save("Locked release " + r.name); err != nil {
+		r.lock = old
+		return err
+	}
+	return nil
+}
+
+// How we represent a build in the YAML metadata.
+type YAMLBuild struct {
+	name, parent string
+	release      *YAMLRelease
+	barclamps    BarclampMap
+}
+
+// The basic name of a build.
+func (b *YAMLBuild) Name() string {
+	return b.name
+}
+
+// The full name of a build.
+// Equal to release.Name() + / + build.Name()
+func (b *YAMLBuild) FullName() string {
+	return b.release.Name() + "/" + b.name
+}
+
+// The release that this build is a part of.
+func (b *YAMLBuild) Release() Release {
+	return Release(b.release)
+}
+
+// The parent build of this one.
+// Probe verifies that all parents exist, so this will only return nil
+// if the build has no parent.
+func (b *YAMLBuild) Parent() Build {
+	if res := b.release.builds[b.parent]; res != nil {
+		return Build(res)
+	}
+	return nil
+}
+
+// The barclamps that are a part of this build.
+func (b *YAMLBuild) Barclamps() BarclampMap {
+	return b.barclamps
+}
+
+// Perform switch finalization for YAMLMetadata.
+// The extra and change-image directories still live under
+// releases/<release>/<build>, so we link to them there.
+func (b *YAMLBuild) FinalizeSwitch() error {
+	ws := b.release.meta.ws
+	return ws.linkBuildExtras(filepath.Join(ws.Repo.Path(), "releases", b.release.name, b.name))
+}
+
+// Zap a build.  This erases the build from releases.yml.
+func (b *YAMLBuild) Zap() error {
+	for _, build := range b.release.builds {
+		if build.parent == b.name {
+			return fmt.Errorf("Cannot delete build with active children!")
+		}
+	}
+	delete(b.release.builds, b.name)
+	return b.release.meta.save("Removed build " + b.FullName())
+}
+
+// Add a barclamp to a build or change its branch in releases.yml.
+func (b *YAMLBuild) SetBarclamp(bc *Barclamp) error {
+	commitmsg := fmt.Sprintf("Added barclamp %s on %s to build %s", bc.Name, bc.Branch, b.FullName())
+	old, found := b.barclamps[bc.Name]
+	if found {
+		commitmsg = fmt.Sprintf("Changed barclamp %s in build %s from %s to %s",
+			bc.Name, b.FullName(), old.Branch, bc.Branch)
+	}
+	b.barclamps[bc.Name] = bc
+	if err := b.release.meta.save(commitmsg); err != nil {
+		if found {
+			b.barclamps[bc.Name] = old
+		} else {
+			delete(b.barclamps, bc.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove a barclamp from a build in releases.yml.
+func (b *YAMLBuild) RemoveBarclamp(name string) error {
+	old, found := b.barclamps[name]
+	if !found {
+		return fmt.Errorf("%w: barclamp %s is not in build %s", ErrInvalidBuild, name, b.FullName())
+	}
+	delete(b.barclamps, name)
+	if err := b.release.meta.save(fmt.Sprintf("Removed barclamp %s from build %s", name, b.FullName())); err != nil {
+		b.barclamps[name] = old
+		return err
+	}
+	return nil
+}
+
+// Get a list of releases that this metadata knows about
+func (m *YAMLMetadata) Releases() ReleaseMap {
+	res := make(ReleaseMap)
+	for name, rel := range m.releases {
+		res[name] = rel
+	}
+	return res
+}
+
+// Translate the releases we know about into their on-disk format.
+func (m *YAMLMetadata) doc() *yamlDoc {
+	res := &yamlDoc{Releases: make(map[string]*yamlReleaseDoc)}
+	for name, rel := range m.releases {
+		rdoc := &yamlReleaseDoc{
+			Parent: rel.parent,
+			Builds: make(map[string]*yamlBuildDoc),
+		}
+		for bname, build := range rel.builds {
+			bdoc := &yamlBuildDoc{
+				Parent:    build.parent,
+				Barclamps: make(map[string]string),
+			}
+			for bcname, bc := range build.barclamps {
+				bdoc.Barclamps[bcname] = bc.Branch
+			}
+			rdoc.Builds[bname] = bdoc
+		}
+		if rel.lock != nil {
+			rdoc.Lock = rel.lock
+		}
+		if len(rel.tags) > 0 {
+			rdoc.Tags = make(map[string]map[string]string)
+			for tag, snap := range rel.tags {
+				rdoc.Tags[tag] = snap
+			}
+		}
+		res.Releases[name] = rdoc
+	}
+	return res
+}
+
+// Write releases.yml out and commit it with commitmsg.
+func (m *YAMLMetadata) save(commitmsg string) error {
+	buf, err := goyaml.Marshal(m.doc())
+	if err != nil {
+		return err
+	}
+	return m.store.store(buf, commitmsg, true)
+}
+
+// Populate the releases from releases.yml, if we are using YAML metadata.
+func (m *YAMLMetadata) Probe() error {
+	m.releases = make(map[string]*YAMLRelease)
+	buf, err := m.store.load()
+	if err != nil {
+		return err
+	}
+	doc := &yamlDoc{}
+	if err = goyaml.Unmarshal(buf, doc); err != nil {
+		return fmt.Errorf("%w: cannot parse %s: %v", ErrBadMetadata, m.store, err)
+	}
+	for name, rdoc := range doc.Releases {
+		rel := &YAMLRelease{
+			name:   name,
+			meta:   m,
+			builds: make(map[string]*YAMLBuild),
+			tags:   make(map[string]Snapshot),
+		}
+		if rdoc == nil {
+			m.releases[name] = rel
+			continue
+		}
+		rel.parent = rdoc.Parent
+		for tag, snap := range rdoc.Tags {
+			rel.tags[tag] = snap
+		}
+		if rdoc.Lock != nil {
+			rel.lock = rdoc.Lock
+		}
+		for bname, bdoc := range rdoc.Builds {
+			build := &YAMLBuild{
+				name:      bname,
+				release:   rel,
+				barclamps: make(BarclampMap),
+			}
+			if bdoc != nil {
+				build.parent = bdoc.Parent
+				for bcname, branch := range bdoc.Barclamps {
+					build.barclamps[bcname] = &Barclamp{
+						Name:   bcname,
+						Branch: branch,
+						Repo:   m.ws.Barclamps[bcname],
+					}
+				}
+			}
+			rel.builds[bname] = build
+		}
+		m.releases[name] = rel
+	}
+	for _, rel := range m.releases {
+		if rel.parent != "" && m.releases[rel.parent] == nil {
+			return fmt.Errorf("%w: parent release %s of %s does not exist",
+				ErrBadMetadata, rel.parent, rel.name)
+		}
+		for _, build := range rel.builds {
+			if build.parent != "" && rel.builds[build.parent] == nil {
+				return fmt.Errorf("%w: cannot find parent build %s of %s",
+					ErrBadMetadata, build.parent, build.FullName())
+			}
+		}
+	}
+	return nil
+}
+
+// The name of the YAML metadata backend.
+func (m *YAMLMetadata) backendName() string {
+	return m.store.backendName()
+}
+
+// Copy the releases and builds from another Metadata into releases.yml.
+func (m *YAMLMetadata) importFrom(src Metadata) error {
+	m.releases = make(map[string]*YAMLRelease)
+	for name, srcRel := range src.Releases() {
+		rel := &YAMLRelease{
+			name:   name,
+			meta:   m,
+			builds: make(map[string]*YAMLBuild),
+			tags:   srcRel.Tags(),
+			lock:   srcRel.Lock(),
+		}
+		if parent := srcRel.Parent(); parent != nil {
+			rel.parent = parent.Name()
+		}
+		for bname, srcBuild := range srcRel.Builds() {
+			build := &YAMLBuild{
+				name:      bname,
+				release:   rel,
+				barclamps: make(BarclampMap),
+			}
+			if parent := srcBuild.Parent(); parent != nil {
+				build.parent = parent.Name()
+			}
+			for bcname, bc := range srcBuild.Barclamps() {
+				build.barclamps[bcname] = &Barclamp{
+					Name:   bc.Name,
+					Branch: bc.Branch,
+					Repo:   bc.Repo,
+				}
+			}
+			rel.builds[bname] = build
+		}
+		m.releases[name] = rel
+	}
+	buf, err := goyaml.Marshal(m.doc())
+	if err != nil {
+		return err
+	}
+	return m.store.store(buf, "Imported release metadata", false)
+}
+
+// Remove releases.yml.
+func (m *YAMLMetadata) remove() error {
+	return m.store.remove()
+}